@@ -0,0 +1,191 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/mtmox/AI-cluster/cluster"
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/nats_server"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+// generateStats are the timings Ollama reports with a non-streaming generate call
+type generateStats struct {
+	LoadDuration       int64  `json:"load_duration"`
+	PromptEvalCount    int    `json:"prompt_eval_count"`
+	PromptEvalDuration int64  `json:"prompt_eval_duration"`
+	EvalCount          int    `json:"eval_count"`
+	EvalDuration       int64  `json:"eval_duration"`
+	Error              string `json:"error"`
+}
+
+// runningModel is an entry from Ollama's list of models in memory
+type runningModel struct {
+	Name     string `json:"name"`
+	Size     uint64 `json:"size"`
+	SizeVRAM uint64 `json:"size_vram"`
+}
+
+// RunLocalBenchmarks benchmarks every model on this node, records and publishes the results
+func RunLocalBenchmarks() ([]constants.BenchmarkResult, error) {
+	if err := constants.QueryAndWriteModels(); err != nil {
+		return nil, fmt.Errorf("failed to query local models: %v", err)
+	}
+	if err := refreshLocalModels(); err != nil {
+		return nil, fmt.Errorf("failed to read local models: %v", err)
+	}
+
+	var names []string
+	for name := range localModelDigests() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var results []constants.BenchmarkResult
+	for _, name := range names {
+		result, err := RunBenchmark(name)
+		if err != nil {
+			node.HandleError(err, node.ERROR, "Benchmark failed for "+name)
+			continue
+		}
+		results = append(results, *result)
+	}
+	return results, nil
+}
+
+// RunBenchmark runs the prompt suite against one model from a cold start, then records and publishes it
+func RunBenchmark(model string) (*constants.BenchmarkResult, error) {
+	result := &constants.BenchmarkResult{
+		NodeID:  node.GetNodeID(),
+		Model:   model,
+		Prompts: len(constants.BenchmarkPrompts),
+		RunAt:   time.Now(),
+	}
+	if local, ok := localModel(model); ok {
+		result.Digest = local.Digest
+	}
+
+	// Unload first so the first prompt measures a cold load
+	if err := GetModelManager().UnloadModel(model); err != nil {
+		node.HandleError(err, node.WARNING, "Failed to unload before benchmark, load time will read low")
+	}
+
+	var promptTokens, evalTokens int
+	var promptTime, evalTime time.Duration
+	for i, prompt := range constants.BenchmarkPrompts {
+		stats, err := generateOnce(model, prompt)
+		if err != nil {
+			return nil, fmt.Errorf("prompt %d of %d failed: %v", i+1, len(constants.BenchmarkPrompts), err)
+		}
+		if i == 0 {
+			result.LoadSeconds = time.Duration(stats.LoadDuration).Seconds()
+			result.MemoryBytes, result.VRAMBytes = runningModelSize(model)
+		}
+		promptTokens += stats.PromptEvalCount
+		promptTime += time.Duration(stats.PromptEvalDuration)
+		evalTokens += stats.EvalCount
+		evalTime += time.Duration(stats.EvalDuration)
+	}
+
+	if promptTime > 0 {
+		result.PromptTokensPerSecond = float64(promptTokens) / promptTime.Seconds()
+	}
+	if evalTime > 0 {
+		result.GenerationTokensPerSecond = float64(evalTokens) / evalTime.Seconds()
+	}
+
+	recordBenchmark(*result)
+	node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Benchmarked %s: %.1f prompt tok/s, %.1f gen tok/s, %.1fs load",
+		model, result.PromptTokensPerSecond, result.GenerationTokensPerSecond, result.LoadSeconds))
+	return result, nil
+}
+
+// recordBenchmark stores the run locally and publishes it when connected to NATS
+func recordBenchmark(result constants.BenchmarkResult) {
+	if err := node.InsertBenchmark(constants.BenchmarkDatabase, result); err != nil {
+		node.HandleError(err, node.ERROR, "Failed to store benchmark")
+	}
+
+	nc := nats_server.GetConnection()
+	if nc == nil {
+		return
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		node.HandleError(err, node.WARNING, "Benchmark not published")
+		return
+	}
+	if err := cluster.PublishBenchmark(js, result); err != nil {
+		node.HandleError(err, node.WARNING, "Benchmark not published")
+	}
+}
+
+// generateOnce runs a single deterministic, non-streaming generation
+func generateOnce(model, prompt string) (*generateStats, error) {
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"model":  model,
+		"prompt": prompt,
+		"stream": false,
+		// Fixed sampling keeps runs comparable across nodes
+		"options": map[string]interface{}{
+			"temperature": 0,
+			"seed":        42,
+			"num_predict": 256,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal generate request: %v", err)
+	}
+
+	resp, err := http.Post(constants.GenerateEndpoint, "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		ollamaErrors.Inc("benchmark")
+		return nil, fmt.Errorf("failed to send generate request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read generate response: %v", err)
+	}
+
+	var stats generateStats
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal generate response: %v", err)
+	}
+	if stats.Error != "" {
+		ollamaErrors.Inc("benchmark")
+		return nil, fmt.Errorf("ollama: %s", stats.Error)
+	}
+	return &stats, nil
+}
+
+// runningModelSize reports how much memory a loaded model takes, zero if it cannot be read
+func runningModelSize(model string) (uint64, uint64) {
+	resp, err := http.Get(constants.LoadedModels)
+	if err != nil {
+		node.HandleError(err, node.WARNING, "Failed to read model memory use")
+		return 0, 0
+	}
+	defer resp.Body.Close()
+
+	var running struct {
+		Models []runningModel `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&running); err != nil {
+		node.HandleError(err, node.WARNING, "Failed to read model memory use")
+		return 0, 0
+	}
+	for _, m := range running.Models {
+		if m.Name == model {
+			return m.Size, m.SizeVRAM
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,107 @@
+package backend
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/cluster"
+	"github.com/mtmox/AI-cluster/nats_server"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+var (
+	clusterConfig     cluster.ClusterConfig
+	clusterRevision   uint64
+	clusterConfigLock sync.RWMutex
+)
+
+// WatchClusterConfig applies the shared cluster config and this node's overrides as they change
+func WatchClusterConfig(js nats.JetStreamContext) error {
+	return cluster.WatchConfig(js, node.GetNodeID(), func(config cluster.ClusterConfig, revision uint64) {
+		clusterConfigLock.Lock()
+		clusterConfig = config
+		clusterRevision = revision
+		clusterConfigLock.Unlock()
+
+		settingsLock.RLock()
+		current := settings
+		settingsLock.RUnlock()
+		applyRateLimits(current)
+
+		for name, limits := range config.Streams {
+			if err := nats_server.UpdateStreamLimits(js, name, limits.MaxAge(), limits.MaxMsgs); err != nil {
+				node.HandleError(err, node.WARNING, "Failed to apply cluster limits to stream "+name)
+			}
+		}
+	})
+}
+
+// applyRateLimits configures the rate limiter from the node's settings and the cluster config
+func applyRateLimits(s NodeSettings) {
+	limits := s.withClusterLimits()
+	clusterConfigLock.RLock()
+	requesterLimits := clusterConfig.RateLimits
+	clusterConfigLock.RUnlock()
+
+	GetRateLimiter().Configure(limits)
+	GetRateLimiter().ConfigureRequesters(requesterLimits, limits.RateLimitBurst)
+}
+
+// withClusterLimits returns the settings with any rate limits set in the cluster config laid over them
+func (s NodeSettings) withClusterLimits() NodeSettings {
+	clusterConfigLock.RLock()
+	defer clusterConfigLock.RUnlock()
+
+	limits := clusterConfig.RateLimits
+	if limits.NodeRequestsPerMinute != nil {
+		s.NodeRequestsPerMinute = *limits.NodeRequestsPerMinute
+	}
+	if limits.Burst != nil {
+		s.RateLimitBurst = *limits.Burst
+	}
+	if len(limits.ModelRequestsPerMinute) > 0 {
+		models := make(map[string]int, len(s.ModelRequestsPerMinute)+len(limits.ModelRequestsPerMinute))
+		for model, perMinute := range s.ModelRequestsPerMinute {
+			models[model] = perMinute
+		}
+		for model, perMinute := range limits.ModelRequestsPerMinute {
+			models[model] = perMinute
+		}
+		s.ModelRequestsPerMinute = models
+	}
+	return s
+}
+
+// preferredPolicy is how many deliveries and how long per delivery preferred nodes get first
+func preferredPolicy() (int, time.Duration) {
+	clusterConfigLock.RLock()
+	defer clusterConfigLock.RUnlock()
+
+	attempts, delay := defaultPreferredAttempts, defaultPreferredDelay
+	if routing := clusterConfig.Routing; routing.PreferredAttempts != nil {
+		attempts = *routing.PreferredAttempts
+	}
+	if routing := clusterConfig.Routing; routing.PreferredDelayMS != nil {
+		delay = time.Duration(*routing.PreferredDelayMS) * time.Millisecond
+	}
+	return attempts, delay
+}
+
+// pinnedDigest is the digest a request asked for, or the cluster's pin for the model when it asked for none
+func pinnedDigest(model, requested string) string {
+	if requested != "" {
+		return requested
+	}
+	clusterConfigLock.RLock()
+	defer clusterConfigLock.RUnlock()
+	return clusterConfig.ModelPins[model]
+}
+
+// configRevision is the cluster config revision this node is running
+func configRevision() uint64 {
+	clusterConfigLock.RLock()
+	defer clusterConfigLock.RUnlock()
+	return clusterRevision
+}
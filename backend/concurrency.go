@@ -0,0 +1,193 @@
+package backend
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+const (
+	// initialConcurrency is where a model's limit starts before any requests have been measured
+	initialConcurrency = 2.0
+	// backoffRatio shrinks a model's limit when it errors or slows down
+	backoffRatio = 0.75
+	// slowdownTolerance is how far below its best tokens/sec a model may fall before backing off
+	slowdownTolerance = 0.5
+	// latencyTolerance is how far above its best per-token latency a model may rise before backing off
+	latencyTolerance = 2.0
+	// baselineDecay lets the best observed figures drift so one lucky sample does not pin them forever
+	baselineDecay = 0.02
+	// saturatedRetryDelay is how long a request for a model at its limit waits before redelivery
+	saturatedRetryDelay = time.Second
+)
+
+// modelConcurrency is the AIMD state for one model
+type modelConcurrency struct {
+	limit           float64
+	active          int
+	bestTPS         float64
+	bestLatency     float64 // seconds of wall clock per generated token
+	tokensPerSecond float64
+	latencyMS       float64
+	errors          int
+}
+
+// ConcurrencyLimiter adapts how many requests each model runs at once from observed
+// throughput, latency and errors, using additive increase and multiplicative decrease
+type ConcurrencyLimiter struct {
+	models map[string]*modelConcurrency
+	mutex  sync.Mutex
+}
+
+var (
+	concurrencyLimiter *ConcurrencyLimiter
+	limiterOnce        sync.Once
+)
+
+// GetConcurrencyLimiter returns the singleton instance of ConcurrencyLimiter
+func GetConcurrencyLimiter() *ConcurrencyLimiter {
+	limiterOnce.Do(func() {
+		concurrencyLimiter = &ConcurrencyLimiter{models: make(map[string]*modelConcurrency)}
+	})
+	return concurrencyLimiter
+}
+
+// ceiling is the static limit from node-config.json, which adaptive limits never exceed
+func ceiling() float64 {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	return float64(settings.MaxParallelRequests)
+}
+
+func (l *ConcurrencyLimiter) state(model string) *modelConcurrency {
+	state, ok := l.models[model]
+	if !ok {
+		state = &modelConcurrency{limit: math.Min(initialConcurrency, ceiling())}
+		l.models[model] = state
+	}
+	return state
+}
+
+// Acquire reserves a slot for a model, returning false when it is at its limit
+func (l *ConcurrencyLimiter) Acquire(model string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	state := l.state(model)
+	if state.active >= int(state.limit) {
+		return false
+	}
+	state.active++
+	return true
+}
+
+// Release frees a model's slot and adjusts its limit from how the request went
+func (l *ConcurrencyLimiter) Release(model string, elapsed time.Duration, evalCount int, evalDuration time.Duration, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	state := l.state(model)
+	// A limit only grows while it is actually being used, otherwise idle models would creep up forever
+	saturated := state.active >= int(state.limit)
+	if state.active > 0 {
+		state.active--
+	}
+	before := int(state.limit)
+
+	if err != nil || evalCount == 0 || evalDuration <= 0 {
+		state.errors++
+		state.limit = math.Max(1, state.limit*backoffRatio)
+		l.logChange(model, before, state, "request failed")
+		return
+	}
+
+	tps := float64(evalCount) / evalDuration.Seconds()
+	latency := elapsed.Seconds() / float64(evalCount)
+	state.tokensPerSecond = tps
+	state.latencyMS = latency * 1000
+
+	if tps > state.bestTPS {
+		state.bestTPS = tps
+	} else {
+		state.bestTPS -= (state.bestTPS - tps) * baselineDecay
+	}
+	if state.bestLatency == 0 || latency < state.bestLatency {
+		state.bestLatency = latency
+	} else {
+		state.bestLatency += (latency - state.bestLatency) * baselineDecay
+	}
+
+	switch {
+	case tps < state.bestTPS*slowdownTolerance:
+		state.limit = math.Max(1, state.limit*backoffRatio)
+		l.logChange(model, before, state, "tokens/sec dropped")
+	case latency > state.bestLatency*latencyTolerance:
+		state.limit = math.Max(1, state.limit*backoffRatio)
+		l.logChange(model, before, state, "latency rose")
+	case saturated:
+		state.limit = math.Min(ceiling(), state.limit+1/state.limit)
+		l.logChange(model, before, state, "healthy at limit")
+	}
+}
+
+func (l *ConcurrencyLimiter) logChange(model string, before int, state *modelConcurrency, reason string) {
+	if int(state.limit) == before {
+		return
+	}
+	node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Concurrency limit for %s changed %d -> %d (%s)", model, before, int(state.limit), reason))
+}
+
+// Available returns how many more requests could start, using the most permissive model
+// since the model of the next fetched message is not known until it arrives
+func (l *ConcurrencyLimiter) Available() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.models) == 0 {
+		return int(math.Min(initialConcurrency, ceiling()))
+	}
+	available := 0
+	for _, state := range l.models {
+		if free := int(state.limit) - state.active; free > available {
+			available = free
+		}
+	}
+	return available
+}
+
+// Limit returns the combined limit across models, capped by the static ceiling
+func (l *ConcurrencyLimiter) Limit() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.models) == 0 {
+		return int(math.Min(initialConcurrency, ceiling()))
+	}
+	total := 0
+	for _, state := range l.models {
+		total += int(state.limit)
+	}
+	return int(math.Min(float64(total), ceiling()))
+}
+
+// Snapshot returns the current limit and measurements for every model
+func (l *ConcurrencyLimiter) Snapshot() map[string]constants.ModelConcurrency {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	snapshot := make(map[string]constants.ModelConcurrency, len(l.models))
+	for model, state := range l.models {
+		snapshot[model] = constants.ModelConcurrency{
+			Limit:           int(state.limit),
+			Active:          state.active,
+			TokensPerSecond: state.tokensPerSecond,
+			LatencyMS:       state.latencyMS,
+			Errors:          state.errors,
+		}
+	}
+	return snapshot
+}
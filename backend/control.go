@@ -0,0 +1,181 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/control"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+// Diagnostics is the payload returned by the diagnostics command
+type Diagnostics struct {
+	Heartbeat  *constants.NodeHeartbeat `json:"heartbeat"`
+	Settings   NodeSettings             `json:"settings"`
+	Goroutines int                      `json:"goroutines"`
+	GoVersion  string                   `json:"go_version"`
+	StartedAt  time.Time                `json:"started_at"`
+}
+
+var startedAt = time.Now()
+
+// ListenForControl answers signed admin commands sent to this node
+func ListenForControl(nc *nats.Conn) error {
+	key, err := control.LoadKey()
+	if err != nil {
+		node.HandleError(err, node.WARNING, "No control key, remote control is disabled on this node")
+		return err
+	}
+	verifier := control.NewVerifier(key)
+
+	if err := node.CreateAuditDatabase(constants.AuditDatabase); err != nil {
+		node.HandleError(err, node.ERROR, "Failed to create audit database")
+		return err
+	}
+
+	subject := control.Subject(node.GetNodeID())
+	_, err = nc.Subscribe(subject, func(msg *nats.Msg) {
+		handleControl(msg, verifier)
+	})
+	if err != nil {
+		node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to subscribe to control subject %s", subject))
+		return fmt.Errorf("failed to subscribe to control subject: %v", err)
+	}
+
+	node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Listening for control commands on %s", subject))
+	return nil
+}
+
+func handleControl(msg *nats.Msg, verifier *control.Verifier) {
+	reply := control.Reply{NodeID: node.GetNodeID()}
+
+	var cmd control.Command
+	if err := json.Unmarshal(msg.Data, &cmd); err != nil {
+		reply.Message = fmt.Sprintf("invalid command: %v", err)
+		respondControl(msg, cmd, reply, false)
+		return
+	}
+	reply.Command = cmd.Command
+
+	if err := verifier.Verify(&cmd); err != nil {
+		node.HandleError(err, node.WARNING, fmt.Sprintf("Rejected %s command from %s", cmd.Command, cmd.Issuer))
+		reply.Message = fmt.Sprintf("rejected: %v", err)
+		respondControl(msg, cmd, reply, false)
+		return
+	}
+
+	var restart bool
+	switch cmd.Command {
+	case control.ReloadSettings:
+		if err := LoadNodeSettings(); err != nil {
+			reply.Message = fmt.Sprintf("failed to reload settings: %v", err)
+			break
+		}
+		reply.OK, reply.Message = true, "settings reloaded"
+	case control.Drain:
+		SetDraining(true)
+		reply.OK, reply.Message = true, "draining, no new messages will be fetched"
+	case control.Resume:
+		SetDraining(false)
+		reply.OK, reply.Message = true, "resumed"
+	case control.SetMaxParallel:
+		value, err := strconv.Atoi(cmd.Args["value"])
+		if err != nil || value < 1 {
+			reply.Message = fmt.Sprintf("invalid max parallel value %q", cmd.Args["value"])
+			break
+		}
+		if err := SetMaxParallel(value); err != nil {
+			reply.Message = fmt.Sprintf("limit applied but not saved: %v", err)
+			break
+		}
+		reply.OK, reply.Message = true, fmt.Sprintf("max parallel requests set to %d", value)
+	case control.UnloadAll:
+		if err := GetModelManager().UnloadAllModels(); err != nil {
+			reply.Message = fmt.Sprintf("failed to unload models: %v", err)
+			break
+		}
+		reply.OK, reply.Message = true, "all models unloaded"
+	case control.Diagnostics:
+		data, err := diagnostics()
+		if err != nil {
+			reply.Message = fmt.Sprintf("failed to collect diagnostics: %v", err)
+			break
+		}
+		reply.OK, reply.Message, reply.Data = true, "ok", data
+	case control.RestartBackend:
+		restart = true
+		reply.OK, reply.Message = true, "restarting"
+	default:
+		reply.Message = fmt.Sprintf("unknown command %q", cmd.Command)
+	}
+
+	respondControl(msg, cmd, reply, true)
+
+	if restart {
+		restartProcess()
+	}
+}
+
+// respondControl acknowledges the command and writes it to the audit log
+func respondControl(msg *nats.Msg, cmd control.Command, reply control.Reply, accepted bool) {
+	args, _ := json.Marshal(cmd.Args)
+	if err := node.InsertAudit(constants.AuditDatabase, time.Now().Format("2006-01-02 15:04:05"), cmd.Issuer, cmd.Command, string(args), accepted, reply.Message); err != nil {
+		node.HandleError(err, node.ERROR, "Failed to write audit record")
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Failed to marshal control reply")
+		return
+	}
+	if err := msg.Respond(data); err != nil {
+		node.HandleError(err, node.WARNING, "Failed to reply to control command")
+	}
+}
+
+func diagnostics() (json.RawMessage, error) {
+	heartbeat, err := buildHeartbeat(node.GetNodeID())
+	if err != nil {
+		return nil, err
+	}
+
+	settingsLock.RLock()
+	current := settings
+	settingsLock.RUnlock()
+
+	return json.Marshal(Diagnostics{
+		Heartbeat:  heartbeat,
+		Settings:   current,
+		Goroutines: runtime.NumGoroutine(),
+		GoVersion:  runtime.Version(),
+		StartedAt:  startedAt,
+	})
+}
+
+// restartProcess replaces this process with a fresh copy of itself
+func restartProcess() {
+	executable, err := os.Executable()
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Failed to find executable for restart")
+		return
+	}
+
+	node.HandleError(nil, node.SUCCESS, "Restarting backend on remote request")
+	// A supervised Ollama would otherwise outlive the exec and block the new one from starting
+	if ollamaSupervisor != nil {
+		ollamaSupervisor.Stop()
+	}
+	// Give the reply a moment to leave before the connection goes away
+	time.Sleep(500 * time.Millisecond)
+	if err := syscall.Exec(executable, os.Args, os.Environ()); err != nil {
+		node.HandleError(err, node.ERROR, "Failed to restart backend")
+	}
+}
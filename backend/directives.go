@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+// ListenForDirectives applies load and unload directives sent by the scheduler
+func ListenForDirectives(nc *nats.Conn) error {
+	subject := fmt.Sprintf("%s.%s", constants.DirectiveSubject, node.GetNodeID())
+
+	_, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+		var directive constants.PlacementDirective
+		if err := json.Unmarshal(msg.Data, &directive); err != nil {
+			node.HandleError(err, node.ERROR, "Failed to unmarshal placement directive")
+			return
+		}
+		go func() {
+			result := applyDirective(directive)
+			if msg.Reply == "" {
+				return
+			}
+			data, err := json.Marshal(result)
+			if err != nil {
+				node.HandleError(err, node.ERROR, "Failed to marshal directive result")
+				return
+			}
+			if err := msg.Respond(data); err != nil {
+				node.HandleError(err, node.WARNING, "Failed to reply to directive")
+			}
+		}()
+	})
+	if err != nil {
+		node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to subscribe to directives on %s", subject))
+		return fmt.Errorf("failed to subscribe to directives: %v", err)
+	}
+
+	node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Listening for placement directives on %s", subject))
+	return nil
+}
+
+func applyDirective(directive constants.PlacementDirective) constants.DirectiveResult {
+	mm := GetModelManager()
+	result := constants.DirectiveResult{
+		NodeID: node.GetNodeID(),
+		Action: directive.Action,
+		Model:  directive.Model,
+	}
+
+	switch directive.Action {
+	case constants.DirectiveLoad:
+		node.HandleError(nil, node.INFO, fmt.Sprintf("Scheduler asked to load %s: %s", directive.Model, directive.Reason))
+		if err := mm.LoadModel(directive.Model); err != nil {
+			node.HandleError(err, node.ERROR, "Failed to load model "+directive.Model)
+			result.Error = err.Error()
+			return result
+		}
+		node.HandleError(nil, node.SUCCESS, "Loaded model on scheduler request: "+directive.Model)
+	case constants.DirectiveUnload:
+		node.HandleError(nil, node.INFO, fmt.Sprintf("Scheduler asked to unload %s: %s", directive.Model, directive.Reason))
+		if err := mm.UnloadModel(directive.Model); err != nil {
+			node.HandleError(err, node.ERROR, "Failed to unload model "+directive.Model)
+			result.Error = err.Error()
+			return result
+		}
+		node.HandleError(nil, node.SUCCESS, "Unloaded model on scheduler request: "+directive.Model)
+	case constants.DirectivePull:
+		node.HandleError(nil, node.INFO, fmt.Sprintf("Asked to re-pull %s: %s", directive.Model, directive.Reason))
+		digest, err := pullModel(directive.Model)
+		if err != nil {
+			node.HandleError(err, node.ERROR, "Failed to pull model "+directive.Model)
+			result.Error = err.Error()
+			return result
+		}
+		result.Digest = digest
+		node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Pulled model %s at digest %s", directive.Model, digest))
+	case constants.DirectiveBenchmark:
+		node.HandleError(nil, node.INFO, fmt.Sprintf("Asked to benchmark %s: %s", directive.Model, directive.Reason))
+		benchmark, err := RunBenchmark(directive.Model)
+		if err != nil {
+			node.HandleError(err, node.ERROR, "Failed to benchmark model "+directive.Model)
+			result.Error = err.Error()
+			return result
+		}
+		result.Benchmark = benchmark
+	default:
+		err := fmt.Errorf("unknown action: %s", directive.Action)
+		node.HandleError(err, node.WARNING, "Ignoring placement directive")
+		result.Error = err.Error()
+	}
+
+	return result
+}
@@ -0,0 +1,205 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/metrics"
+	"github.com/mtmox/AI-cluster/nats_server"
+	"github.com/mtmox/AI-cluster/node"
+	"github.com/mtmox/AI-cluster/streams"
+)
+
+// HealthCheck is the outcome of one readiness check
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthReport is the JSON body of /healthz and /readyz
+type HealthReport struct {
+	Status  string        `json:"status"`
+	NodeID  string        `json:"node_id"`
+	Name    string        `json:"name"`
+	Version string        `json:"version"`
+	Uptime  string        `json:"uptime"`
+	Checks  []HealthCheck `json:"checks,omitempty"`
+}
+
+// messageSubscription is the chat consumer binding, set once ProcessMessage has subscribed
+var messageSubscription *nats.Subscription
+
+// RegisterHealthEndpoints adds /healthz and /readyz to the HTTP server started with -http
+func RegisterHealthEndpoints() {
+	metrics.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, newHealthReport(nil))
+	}))
+	metrics.Handle("/readyz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, newHealthReport(readinessChecks()))
+	}))
+}
+
+func newHealthReport(checks []HealthCheck) HealthReport {
+	report := HealthReport{
+		Status:  "ok",
+		NodeID:  node.GetNodeID(),
+		Name:    node.GetIdentity().DisplayName(),
+		Version: constants.BuildVersion,
+		Uptime:  time.Since(startedAt).Round(time.Second).String(),
+		Checks:  checks,
+	}
+	for _, check := range checks {
+		if !check.OK {
+			report.Status = "unavailable"
+		}
+	}
+	return report
+}
+
+func writeHealth(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		node.HandleError(err, node.WARNING, "Failed to write health report")
+	}
+}
+
+// IsReady reports whether every readiness check passes, and which ones failed
+func IsReady() (bool, []string) {
+	var failed []string
+	for _, check := range readinessChecks() {
+		if !check.OK {
+			failed = append(failed, fmt.Sprintf("%s: %s", check.Name, check.Detail))
+		}
+	}
+	return len(failed) == 0, failed
+}
+
+// readinessChecks runs everything a backend needs to take work
+func readinessChecks() []HealthCheck {
+	return []HealthCheck{
+		checkNATS(),
+		checkConsumer(),
+		checkOllama(),
+		checkModelsFile(),
+		checkDraining(),
+	}
+}
+
+func checkNATS() HealthCheck {
+	check := HealthCheck{Name: "nats"}
+	nc := nats_server.GetConnection()
+	if nc == nil {
+		check.Detail = "not connected"
+		return check
+	}
+	// Streams and consumers are still being recovered for a moment after the client reconnects
+	status := nc.Status()
+	state, since := streams.Connection()
+	check.OK = status == nats.CONNECTED && state == streams.Connected
+	check.Detail = fmt.Sprintf("%s since %s", state, since.Format(time.RFC3339))
+	return check
+}
+
+func checkConsumer() HealthCheck {
+	check := HealthCheck{Name: "consumer"}
+	if messageSubscription == nil {
+		check.Detail = "chat consumer not bound yet"
+		return check
+	}
+	info, err := messageSubscription.ConsumerInfo()
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.OK = true
+	check.Detail = fmt.Sprintf("%s on %s, %d pending", info.Name, info.Stream, info.NumPending)
+	return check
+}
+
+func checkOllama() HealthCheck {
+	check := HealthCheck{Name: "ollama", OK: ollamaReady()}
+	if !check.OK {
+		check.Detail = "no answer from " + constants.OllamaVersion
+	}
+	return check
+}
+
+// checkModelsFile makes sure models.json matches what Ollama actually has
+func checkModelsFile() HealthCheck {
+	check := HealthCheck{Name: "models.json"}
+
+	info, err := os.Stat(constants.ModelsOutputFile)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	onDisk, err := constants.ReadModelsInfo(constants.ModelsOutputFile)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	live, err := constants.QueryModels()
+	if err != nil {
+		check.Detail = fmt.Sprintf("cannot compare with Ollama: %v", err)
+		return check
+	}
+
+	written := make(map[string]string, len(onDisk.Models))
+	for _, model := range onDisk.Models {
+		written[model.Name] = model.Digest
+	}
+	stale := len(written) != len(live.Models)
+	for _, model := range live.Models {
+		if written[model.Name] != model.Digest {
+			stale = true
+		}
+	}
+
+	check.OK = !stale
+	check.Detail = fmt.Sprintf("%d models, written %s ago", len(onDisk.Models), time.Since(info.ModTime()).Round(time.Second))
+	if stale {
+		check.Detail = "out of date with Ollama, " + check.Detail
+	}
+	return check
+}
+
+func checkDraining() HealthCheck {
+	check := HealthCheck{Name: "draining", OK: !IsDraining()}
+	if !check.OK {
+		check.Detail = "node is draining and not taking new work"
+	}
+	return check
+}
+
+// modelsRefreshInterval is how often models.json is rewritten from Ollama, so manual pulls are picked up
+const modelsRefreshInterval = time.Minute
+
+// WatchModelsFile keeps models.json in step with Ollama
+func WatchModelsFile() {
+	go func() {
+		ticker := time.NewTicker(modelsRefreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if check := checkModelsFile(); check.OK {
+				continue
+			}
+			if err := constants.QueryAndWriteModels(); err != nil {
+				node.HandleError(err, node.WARNING, "Failed to refresh models.json")
+				continue
+			}
+			if err := refreshLocalModels(); err != nil {
+				node.HandleError(err, node.WARNING, "Failed to reload models after refresh")
+			}
+		}
+	}()
+}
@@ -0,0 +1,161 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/mem"
+
+	"github.com/mtmox/AI-cluster/cluster"
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/node"
+	"github.com/mtmox/AI-cluster/protocol"
+)
+
+var (
+	completions     []time.Time
+	completionsLock sync.Mutex
+)
+
+// recordCompletion notes a finished request for the heartbeat's throughput figure
+func recordCompletion() {
+	completionsLock.Lock()
+	defer completionsLock.Unlock()
+	completions = append(completions, time.Now())
+}
+
+// recentCompletions counts requests finished within the window and forgets older ones
+func recentCompletions(window time.Duration) int {
+	completionsLock.Lock()
+	defer completionsLock.Unlock()
+
+	cutoff := time.Now().Add(-window)
+	kept := completions[:0]
+	for _, completedAt := range completions {
+		if completedAt.After(cutoff) {
+			kept = append(kept, completedAt)
+		}
+	}
+	completions = kept
+	return len(completions)
+}
+
+// StartHeartbeat writes this node's heartbeat to the heartbeat bucket on a fixed interval
+func StartHeartbeat(js nats.JetStreamContext) error {
+	kv, err := js.KeyValue(constants.HeartbeatBucket)
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Failed to open heartbeat bucket")
+		return fmt.Errorf("failed to open heartbeat bucket: %v", err)
+	}
+
+	nodeID := node.GetNodeID()
+
+	go func() {
+		ticker := time.NewTicker(cluster.HeartbeatInterval)
+		defer ticker.Stop()
+		for ; true; <-ticker.C {
+			heartbeat, err := buildHeartbeat(nodeID)
+			if err != nil {
+				node.HandleError(err, node.WARNING, "Failed to build heartbeat")
+				continue
+			}
+
+			data, err := json.Marshal(heartbeat)
+			if err != nil {
+				node.HandleError(err, node.ERROR, "Failed to marshal heartbeat")
+				continue
+			}
+
+			if _, err := kv.Put(nodeID, data); err != nil {
+				node.HandleError(err, node.WARNING, "Failed to write heartbeat")
+			}
+		}
+	}()
+
+	node.HandleError(nil, node.SUCCESS, "Heartbeat started for node "+nodeID)
+	return nil
+}
+
+func buildHeartbeat(nodeID string) (*constants.NodeHeartbeat, error) {
+	heartbeat := &constants.NodeHeartbeat{
+		NodeLoadReport: constants.NodeLoadReport{
+			NodeID:    nodeID,
+			Timestamp: time.Now(),
+		},
+		Name:              node.GetIdentity().Name,
+		Labels:            NodeLabels(),
+		IP:                node.GetIP(),
+		Version:           constants.BuildVersion,
+		OllamaReachable:   ollamaReachable(),
+		RequestsPerMinute: recentCompletions(time.Minute),
+		Draining:          IsDraining(),
+		Protocol:          protocol.Supported,
+	}
+	heartbeat.LastError, heartbeat.LastErrorAt = node.LastError()
+	heartbeat.Ready, heartbeat.NotReady = IsReady()
+
+	// A node whose Ollama is down still heartbeats, it just reports nothing loaded
+	if heartbeat.OllamaReachable {
+		loaded, err := GetModelManager().GetLoadedModels()
+		if err != nil {
+			node.HandleError(err, node.WARNING, "Failed to list loaded models for heartbeat")
+		}
+		for _, model := range loaded {
+			heartbeat.LoadedModels = append(heartbeat.LoadedModels, model.Model)
+		}
+	}
+
+	heartbeat.ModelDigests = localModelDigests()
+	for name := range heartbeat.ModelDigests {
+		heartbeat.AvailableModels = append(heartbeat.AvailableModels, name)
+	}
+	sort.Strings(heartbeat.AvailableModels)
+
+	v, err := mem.VirtualMemory()
+	if err != nil {
+		return nil, fmt.Errorf("error getting system memory: %v", err)
+	}
+	heartbeat.MemoryTotal = v.Total
+	heartbeat.MemoryUsed = v.Used
+
+	// A zero interval measures usage since the previous call, so it never blocks
+	percents, err := cpu.Percent(0, false)
+	if err != nil {
+		return nil, fmt.Errorf("error getting CPU usage: %v", err)
+	}
+	if len(percents) > 0 {
+		heartbeat.CPUPercent = percents[0]
+	}
+
+	tasksLock.Lock()
+	heartbeat.ActiveTasks = activeTasks
+	tasksLock.Unlock()
+
+	heartbeat.MaxParallel = GetConcurrencyLimiter().Limit()
+	heartbeat.Concurrency = GetConcurrencyLimiter().Snapshot()
+	heartbeat.Throttle = GetRateLimiter().Snapshot()
+	heartbeat.ConfigRevision = configRevision()
+
+	settingsLock.RLock()
+	heartbeat.MaxLoadedModels = settings.MaxLoadedModels
+	settingsLock.RUnlock()
+
+	return heartbeat, nil
+}
+
+// ollamaReachable reports whether the local Ollama answers on its base URL
+func ollamaReachable() bool {
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(constants.OllamaURL)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
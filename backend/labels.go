@@ -0,0 +1,53 @@
+package backend
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/shirou/gopsutil/v3/mem"
+
+	"github.com/mtmox/AI-cluster/node"
+)
+
+var (
+	systemLabels     map[string]string
+	systemLabelsOnce sync.Once
+)
+
+// detectSystemLabels describes the hardware so requests can ask for things like ram>=64
+func detectSystemLabels() map[string]string {
+	systemLabelsOnce.Do(func() {
+		systemLabels = map[string]string{
+			"cpus": strconv.Itoa(runtime.NumCPU()),
+			"os":   runtime.GOOS,
+			"arch": runtime.GOARCH,
+		}
+		if v, err := mem.VirtualMemory(); err == nil {
+			systemLabels["ram"] = strconv.Itoa(int(v.Total / (1024 * 1024 * 1024)))
+		} else {
+			node.HandleError(err, node.WARNING, "Failed to read memory for the ram label")
+		}
+	})
+	return systemLabels
+}
+
+// NodeLabels returns the labels this node advertises. Detected hardware labels are
+// overridden by identity labels, which are overridden by labels in node-config.json.
+func NodeLabels() map[string]string {
+	labels := make(map[string]string)
+	for key, value := range detectSystemLabels() {
+		labels[key] = value
+	}
+	for key, value := range node.GetIdentity().Labels {
+		labels[key] = value
+	}
+
+	settingsLock.RLock()
+	for key, value := range settings.Labels {
+		labels[key] = value
+	}
+	settingsLock.RUnlock()
+
+	return labels
+}
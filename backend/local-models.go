@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+var (
+	localModels     map[string]constants.Model
+	localModelsLock sync.RWMutex
+
+	// upgradingModels are being re-pulled and must not take new requests on this node
+	upgradingModels = make(map[string]bool)
+)
+
+// refreshLocalModels re-reads the models this node has on disk from models.json
+func refreshLocalModels() error {
+	modelsInfo, err := constants.ReadModelsInfo(constants.ModelsOutputFile)
+	if err != nil {
+		return err
+	}
+
+	models := make(map[string]constants.Model, len(modelsInfo.Models))
+	for _, model := range modelsInfo.Models {
+		models[model.Name] = model
+	}
+
+	localModelsLock.Lock()
+	localModels = models
+	localModelsLock.Unlock()
+	return nil
+}
+
+// localModel returns the on-disk model for a tag, if this node has it
+func localModel(name string) (constants.Model, bool) {
+	localModelsLock.RLock()
+	defer localModelsLock.RUnlock()
+	model, ok := localModels[name]
+	return model, ok
+}
+
+// localModelDigests maps every local tag to its digest
+func localModelDigests() map[string]string {
+	localModelsLock.RLock()
+	defer localModelsLock.RUnlock()
+
+	digests := make(map[string]string, len(localModels))
+	for name, model := range localModels {
+		digests[name] = model.Digest
+	}
+	return digests
+}
+
+// canServeModel reports whether this node should take a request for the model and optional pinned digest
+func canServeModel(name, pinnedDigest string) (bool, string) {
+	model, ok := localModel(name)
+	if !ok {
+		return false, fmt.Sprintf("Model %s not found in local models", name)
+	}
+
+	localModelsLock.RLock()
+	upgrading := upgradingModels[name]
+	localModelsLock.RUnlock()
+	if upgrading {
+		return false, fmt.Sprintf("Model %s is being upgraded on this node", name)
+	}
+
+	// A pinned digest may be a prefix so users can paste the short form
+	if pinnedDigest != "" && !strings.HasPrefix(model.Digest, pinnedDigest) {
+		return false, fmt.Sprintf("Model %s digest %s does not match pinned digest %s", name, model.Digest, pinnedDigest)
+	}
+	return true, ""
+}
+
+// pullModel re-pulls a tag from the registry and returns its new digest.
+// The model is withheld from new requests on this node while the pull runs.
+func pullModel(name string) (string, error) {
+	localModelsLock.Lock()
+	upgradingModels[name] = true
+	localModelsLock.Unlock()
+	defer func() {
+		localModelsLock.Lock()
+		delete(upgradingModels, name)
+		localModelsLock.Unlock()
+	}()
+
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"model":  name,
+		"stream": false,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal pull request: %v", err)
+	}
+
+	resp, err := http.Post(constants.PullModels, "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		ollamaErrors.Inc("pull")
+		return "", fmt.Errorf("failed to send pull request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read pull response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		ollamaErrors.Inc("pull")
+		return "", fmt.Errorf("pull of %s failed: %s: %s", name, resp.Status, string(body))
+	}
+
+	// Any weights still in memory are the old ones
+	if err := GetModelManager().UnloadModel(name); err != nil {
+		node.HandleError(err, node.WARNING, "Failed to unload model after pull "+name)
+	}
+
+	if err := constants.QueryAndWriteModels(); err != nil {
+		return "", fmt.Errorf("failed to refresh models after pull: %v", err)
+	}
+	if err := refreshLocalModels(); err != nil {
+		return "", fmt.Errorf("failed to reload models after pull: %v", err)
+	}
+
+	model, ok := localModel(name)
+	if !ok {
+		return "", fmt.Errorf("model %s missing after pull", name)
+	}
+	return model.Digest, nil
+}
@@ -0,0 +1,25 @@
+package backend
+
+import (
+	"github.com/mtmox/AI-cluster/metrics"
+)
+
+var (
+	fetchesTotal     = metrics.NewCounter("ai_cluster_backend_fetches_total", "Queue fetches by result (messages, empty, error)", "result")
+	messagesFetched  = metrics.NewCounter("ai_cluster_backend_messages_fetched_total", "Messages fetched from the chat queue")
+	activeTasksGauge = metrics.NewGauge("ai_cluster_backend_active_tasks", "Requests currently being processed")
+	requestDuration  = metrics.NewHistogram("ai_cluster_backend_request_duration_seconds", "Time Ollama took to answer a request per model", metrics.DefaultBuckets, "model")
+	tokensPerSecond  = metrics.NewGauge("ai_cluster_backend_tokens_per_second", "Generation speed of the most recent request per model", "model")
+	generatedTokens  = metrics.NewCounter("ai_cluster_backend_generated_tokens_total", "Tokens generated per model", "model")
+	ollamaErrors     = metrics.NewCounter("ai_cluster_backend_ollama_errors_total", "Failed calls to Ollama by operation", "operation")
+	modelEvents      = metrics.NewCounter("ai_cluster_backend_model_events_total", "Model load and unload events", "model", "event")
+)
+
+func init() {
+	metrics.OnScrape(func() {
+		tasksLock.Lock()
+		active := activeTasks
+		tasksLock.Unlock()
+		activeTasksGauge.Set(float64(active))
+	})
+}
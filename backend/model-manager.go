@@ -4,6 +4,7 @@ package backend
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"sync"
@@ -119,10 +120,12 @@ func (mm *ModelManager) UnloadModel(modelName string) error {
 
 	resp, err := http.Post(constants.ChatEndpoint, "application/json", bytes.NewBuffer(requestBody))
 	if err != nil {
+		ollamaErrors.Inc("unload")
 		node.HandleError(err, node.ERROR, "Failed to send unload request")
 		return err
 	}
 	defer resp.Body.Close()
+	modelEvents.Inc(modelName, "unload")
 
 	mm.mutex.Lock()
 	delete(mm.loadedModels, modelName)
@@ -131,6 +134,51 @@ func (mm *ModelManager) UnloadModel(modelName string) error {
 	return nil
 }
 
+// LoadModel asks Ollama to load a model into memory without generating anything
+func (mm *ModelManager) LoadModel(modelName string) error {
+	if err := mm.CheckAndUnloadModels(modelName); err != nil {
+		node.HandleError(err, node.WARNING, "Warning: Error checking/unloading models before load")
+	}
+
+	request := struct {
+		Model string `json:"model"`
+	}{
+		Model: modelName,
+	}
+
+	requestBody, err := json.Marshal(request)
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Failed to marshal load request")
+		return err
+	}
+
+	resp, err := http.Post(constants.GenerateEndpoint, "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		ollamaErrors.Inc("load")
+		node.HandleError(err, node.ERROR, "Failed to send load request")
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		ollamaErrors.Inc("load")
+		err := fmt.Errorf("unexpected status loading model %s: %s", modelName, resp.Status)
+		node.HandleError(err, node.ERROR, "Ollama rejected load request")
+		return err
+	}
+
+	modelEvents.Inc(modelName, "load")
+	mm.mutex.Lock()
+	mm.loadedModels[modelName] = &LoadedModelInfo{
+		Model:    modelName,
+		LoadedAt: time.Now(),
+		LastUsed: time.Now(),
+	}
+	mm.mutex.Unlock()
+
+	return nil
+}
+
 // CheckAndUnloadModels checks if we need to unload any models before loading a new one
 func (mm *ModelManager) CheckAndUnloadModels(requestedModel string) error {
 	node.HandleError(nil, node.INFO, "Checking and potentially unloading models for requested model: "+requestedModel)
@@ -181,6 +229,28 @@ func (mm *ModelManager) CheckAndUnloadModels(requestedModel string) error {
 	return nil
 }
 
+// SetMaxModels changes how many models may be loaded at once
+func (mm *ModelManager) SetMaxModels(maxModels int) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+	mm.maxModels = maxModels
+}
+
+// UnloadAllModels unloads every model Ollama currently has in memory
+func (mm *ModelManager) UnloadAllModels() error {
+	loadedModels, err := mm.GetLoadedModels()
+	if err != nil {
+		return err
+	}
+
+	for _, model := range loadedModels {
+		if err := mm.UnloadModel(model.Model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // UpdateModelUsage marks a model as recently used
 func (mm *ModelManager) UpdateModelUsage(modelName string) {
 	mm.mutex.Lock()
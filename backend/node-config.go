@@ -19,11 +19,16 @@ func nodeConfig() error {
 	}
 	ramGB := int(v.Total / (1024 * 1024 * 1024))
 
-	maxParallel := ramGB / 2
+	// Manual edits to node-config.json win over the RAM based default
+	merged, err := SaveNodeSettings(ramGB / 2)
+	if err != nil {
+		return fmt.Errorf("failed to save node settings: %v", err)
+	}
+	maxParallel := merged.MaxParallelRequests
 
 	envVars := map[string]map[string]string{
 		"OLLAMA_MAX_LOADED_MODELS": {
-			"value":       "2",
+			"value":       strconv.Itoa(merged.MaxLoadedModels),
 			"description": "Maximum number of loaded models per GPU",
 		},
 		"OLLAMA_NUM_PARALLEL": {
@@ -32,19 +37,26 @@ func nodeConfig() error {
 		},
 	}
 
+	ollamaEnv := make(map[string]string)
 	for key, data := range envVars {
 		os.Setenv(key, data["value"])
+		ollamaEnv[key] = data["value"]
 		fmt.Printf("Set %s=%s - %s\n", key, data["value"], data["description"])
 	}
 
-	// Save the node settings
-	if err := SaveNodeSettings(maxParallel); err != nil {
-		return fmt.Errorf("failed to save node settings: %v", err)
-	}
-
 	fmt.Println("\nOllama configuration complete.")
 	fmt.Printf("System RAM: %d GB\n", ramGB)
 	fmt.Printf("OLLAMA_NUM_PARALLEL: %d\n", maxParallel)
+
+	// A supervised Ollama is started with the computed environment instead of hoping an external one restarts
+	if merged.ManageOllama {
+		if err := GetOllamaSupervisor().Start(ollamaEnv); err != nil {
+			return fmt.Errorf("failed to start supervised Ollama: %v", err)
+		}
+		fmt.Println("Ollama is running as a supervised child process.")
+		return nil
+	}
+
 	fmt.Println("Note: You may need to restart Ollama for changes to take effect.")
 	fmt.Println("To stop Ollama, use the following command:")
 	fmt.Println("pkill ollama")
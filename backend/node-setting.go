@@ -3,43 +3,121 @@ package backend
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
-	"os/user"
 	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/mtmox/AI-cluster/config"
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/node"
 )
 
 type NodeSettings struct {
 	MaxParallelRequests int `json:"max_parallel_requests"`
 	MessageDelayMS      int `json:"message_delay_ms"`
 	MaxLoadedModels     int `json:"max_loaded_models"`
+	// ManageOllama makes the backend run Ollama as a supervised child process
+	ManageOllama bool `json:"manage_ollama"`
+	// NodeRequestsPerMinute caps new requests across all models, 0 falls back to message_delay_ms
+	NodeRequestsPerMinute int `json:"node_requests_per_minute"`
+	// ModelRequestsPerMinute caps new requests for individual models
+	ModelRequestsPerMinute map[string]int `json:"model_requests_per_minute"`
+	// RateLimitBurst is how many requests each bucket lets through back to back
+	RateLimitBurst int `json:"rate_limit_burst"`
+	// Labels are matched against request constraints such as team=platform
+	Labels map[string]string `json:"labels"`
+}
+
+// settingsPollInterval is how often node-config.json is checked for edits
+const settingsPollInterval = 2 * time.Second
+
+// Validate rejects settings the processing loop cannot run with
+func (s NodeSettings) Validate() error {
+	if s.MaxParallelRequests < 1 {
+		return fmt.Errorf("max_parallel_requests must be at least 1, got %d", s.MaxParallelRequests)
+	}
+	if s.MessageDelayMS < 0 {
+		return fmt.Errorf("message_delay_ms cannot be negative, got %d", s.MessageDelayMS)
+	}
+	if s.MaxLoadedModels < 1 {
+		return fmt.Errorf("max_loaded_models must be at least 1, got %d", s.MaxLoadedModels)
+	}
+	if s.NodeRequestsPerMinute < 0 {
+		return fmt.Errorf("node_requests_per_minute cannot be negative, got %d", s.NodeRequestsPerMinute)
+	}
+	for model, perMinute := range s.ModelRequestsPerMinute {
+		if perMinute < 0 {
+			return fmt.Errorf("model_requests_per_minute for %s cannot be negative, got %d", model, perMinute)
+		}
+	}
+	if s.RateLimitBurst < 0 {
+		return fmt.Errorf("rate_limit_burst cannot be negative, got %d", s.RateLimitBurst)
+	}
+	return nil
 }
 
 var (
 	settings     NodeSettings
 	settingsLock sync.RWMutex
-	lastMessage  time.Time
 	activeTasks  int
 	tasksLock    sync.Mutex
+	// draining stops the node fetching new work while in-flight requests finish
+	draining     bool
 )
 
 func getConfigPath() (string, error) {
-	usr, err := user.Current()
+	return constants.NodeConfigFile, nil
+}
+
+// SaveNodeSettings fills in anything missing from node-config.json with defaults.
+// Values already in the file are kept so manual edits survive a restart.
+func SaveNodeSettings(maxParallel int) (NodeSettings, error) {
+	// config.toml supplies the defaults for keys node-config.json does not set
+	defaults := config.Get().Node
+	if defaults.MaxParallelRequests > 0 {
+		maxParallel = defaults.MaxParallelRequests
+	}
+	merged := NodeSettings{
+		MaxParallelRequests:    maxParallel,
+		MessageDelayMS:         defaults.MessageDelayMS,
+		MaxLoadedModels:        defaults.MaxLoadedModels,
+		ManageOllama:           defaults.ManageOllama,
+		NodeRequestsPerMinute:  defaults.NodeRequestsPerMinute,
+		RateLimitBurst:         defaults.RateLimitBurst,
+		ModelRequestsPerMinute: map[string]int{},
+		Labels:                 map[string]string{},
+	}
+	for key, value := range defaults.Labels {
+		merged.Labels[key] = value
+	}
+
+	configPath, err := getConfigPath()
 	if err != nil {
-		return "", err
+		return merged, err
 	}
-	return filepath.Join(usr.HomeDir, "AI-cluster", "backend", "node-config.json"), nil
-}
 
-func SaveNodeSettings(maxParallel int) error {
-	settings := NodeSettings{
-		MaxParallelRequests: maxParallel,
-		MessageDelayMS:      500,
-		MaxLoadedModels:     2, // Default value
+	// Unmarshalling over the defaults only replaces the keys present in the file
+	data, err := os.ReadFile(configPath)
+	if err == nil {
+		if err := json.Unmarshal(data, &merged); err != nil {
+			return merged, fmt.Errorf("existing node config is not valid JSON, leaving it untouched: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return merged, err
+	}
+
+	if err := merged.Validate(); err != nil {
+		return merged, fmt.Errorf("existing node config is invalid, leaving it untouched: %v", err)
 	}
 
-	data, err := json.Marshal(settings)
+	return merged, writeNodeSettings(merged)
+}
+
+// writeNodeSettings writes the given settings to node-config.json
+func writeNodeSettings(settings NodeSettings) error {
+	data, err := json.MarshalIndent(settings, "", "  ")
 	if err != nil {
 		return err
 	}
@@ -78,31 +156,82 @@ func LoadNodeSettings() error {
 		return err
 	}
 
+	var loaded NodeSettings
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return err
+	}
+	if err := loaded.Validate(); err != nil {
+		return err
+	}
+
 	settingsLock.Lock()
-	defer settingsLock.Unlock()
+	settings = loaded
+	settingsLock.Unlock()
 
-	return json.Unmarshal(data, &settings)
+	// The model manager snapshots its limit at creation, so push the new one through
+	GetModelManager().SetMaxModels(loaded.MaxLoadedModels)
+	applyRateLimits(loaded)
+	return nil
 }
 
-func CanProcessMessage() bool {
-	tasksLock.Lock()
-	defer tasksLock.Unlock()
-
-	settingsLock.RLock()
-	defer settingsLock.RUnlock()
-
-	now := time.Now()
-	if now.Sub(lastMessage) < time.Duration(settings.MessageDelayMS)*time.Millisecond {
-		return false
+// WatchNodeSettings reloads node-config.json whenever it changes on disk
+func WatchNodeSettings() {
+	configPath, err := getConfigPath()
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Failed to find node config, settings will not hot-reload")
+		return
 	}
 
-	if activeTasks >= settings.MaxParallelRequests {
-		return false
+	lastModified := time.Time{}
+	if info, err := os.Stat(configPath); err == nil {
+		lastModified = info.ModTime()
 	}
 
-	lastMessage = now
-	activeTasks++
-	return true
+	go func() {
+		ticker := time.NewTicker(settingsPollInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			info, err := os.Stat(configPath)
+			if err != nil || !info.ModTime().After(lastModified) {
+				continue
+			}
+			lastModified = info.ModTime()
+
+			if err := LoadNodeSettings(); err != nil {
+				node.HandleError(err, node.ERROR, "Rejected node-config.json change, keeping previous settings")
+				continue
+			}
+
+			settingsLock.RLock()
+			current := settings
+			settingsLock.RUnlock()
+			node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Reloaded node settings: %+v", current))
+		}
+	}()
+}
+
+// SetMaxParallel changes the parallel request limit and persists it
+func SetMaxParallel(maxParallel int) error {
+	settingsLock.Lock()
+	settings.MaxParallelRequests = maxParallel
+	current := settings
+	settingsLock.Unlock()
+
+	return writeNodeSettings(current)
+}
+
+// SetDraining stops or resumes fetching new messages
+func SetDraining(drain bool) {
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+	draining = drain
+}
+
+// IsDraining reports whether the node is refusing new work
+func IsDraining() bool {
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+	return draining
 }
 
 func FinishProcessing() {
@@ -0,0 +1,194 @@
+package backend
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+const (
+	// ollamaReadyTimeout is how long a freshly started Ollama has to answer its version endpoint
+	ollamaReadyTimeout = 60 * time.Second
+	// ollamaMinBackoff and ollamaMaxBackoff bound the delay between restarts after a crash
+	ollamaMinBackoff = time.Second
+	ollamaMaxBackoff = time.Minute
+	// ollamaStableAfter is how long Ollama must stay up before the backoff resets
+	ollamaStableAfter = 5 * time.Minute
+)
+
+// OllamaSupervisor runs Ollama as a child process and restarts it when it exits
+type OllamaSupervisor struct {
+	env     map[string]string
+	cmd     *exec.Cmd
+	backoff time.Duration
+	stopped bool
+	mutex   sync.Mutex
+}
+
+var (
+	ollamaSupervisor *OllamaSupervisor
+	supervisorOnce   sync.Once
+)
+
+// GetOllamaSupervisor returns the singleton instance of OllamaSupervisor
+func GetOllamaSupervisor() *OllamaSupervisor {
+	supervisorOnce.Do(func() {
+		ollamaSupervisor = &OllamaSupervisor{backoff: ollamaMinBackoff}
+	})
+	return ollamaSupervisor
+}
+
+// Start launches Ollama with the given environment and blocks until it is ready
+func (s *OllamaSupervisor) Start(env map[string]string) error {
+	s.mutex.Lock()
+	s.env = env
+	s.mutex.Unlock()
+
+	if ollamaReady() {
+		return fmt.Errorf("an Ollama not owned by this backend is already listening on %s, stop it first", constants.OllamaURL)
+	}
+
+	if err := s.launch(); err != nil {
+		return err
+	}
+	return waitForOllama(ollamaReadyTimeout)
+}
+
+// Stop kills the supervised Ollama and keeps it from being restarted
+func (s *OllamaSupervisor) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopped = true
+	if s.cmd != nil && s.cmd.Process != nil {
+		if err := s.cmd.Process.Kill(); err != nil {
+			node.HandleError(err, node.WARNING, "Failed to stop Ollama")
+		}
+	}
+}
+
+// launch starts the child process and a goroutine that restarts it when it exits
+func (s *OllamaSupervisor) launch() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		return nil
+	}
+
+	cmd := exec.Command(constants.OllamaBinary, "serve")
+	cmd.Env = os.Environ()
+	for key, value := range s.env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to capture Ollama stdout: %v", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to capture Ollama stderr: %v", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", constants.OllamaBinary, err)
+	}
+	s.cmd = cmd
+	node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Started Ollama with PID %d", cmd.Process.Pid))
+
+	var pipes sync.WaitGroup
+	pipes.Add(2)
+	go forwardOutput(stdout, &pipes)
+	go forwardOutput(stderr, &pipes)
+
+	go s.wait(cmd, &pipes, time.Now())
+	return nil
+}
+
+// wait reaps the child process and restarts it with exponential backoff
+func (s *OllamaSupervisor) wait(cmd *exec.Cmd, pipes *sync.WaitGroup, started time.Time) {
+	// The pipes must be drained before Wait closes them
+	pipes.Wait()
+	err := cmd.Wait()
+	if err == nil {
+		err = fmt.Errorf("exited with status 0")
+	}
+
+	s.mutex.Lock()
+	stopped := s.stopped
+	if time.Since(started) > ollamaStableAfter {
+		s.backoff = ollamaMinBackoff
+	}
+	s.mutex.Unlock()
+	if stopped {
+		return
+	}
+
+	for {
+		delay := s.nextBackoff()
+		node.HandleError(err, node.ERROR, fmt.Sprintf("Ollama stopped, restarting in %s", delay))
+		time.Sleep(delay)
+
+		if err = s.launch(); err == nil {
+			break
+		}
+	}
+
+	if err := waitForOllama(ollamaReadyTimeout); err != nil {
+		node.HandleError(err, node.ERROR, "Restarted Ollama is not answering")
+		return
+	}
+	node.HandleError(nil, node.SUCCESS, "Ollama restarted and ready")
+}
+
+// nextBackoff returns the current restart delay and doubles it for next time
+func (s *OllamaSupervisor) nextBackoff() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delay := s.backoff
+	s.backoff *= 2
+	if s.backoff > ollamaMaxBackoff {
+		s.backoff = ollamaMaxBackoff
+	}
+	return delay
+}
+
+// forwardOutput copies each line the child writes into the node logs
+func forwardOutput(r io.Reader, pipes *sync.WaitGroup) {
+	defer pipes.Done()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		node.LogOutput("ollama", scanner.Text())
+	}
+}
+
+// ollamaReady reports whether Ollama answers its version endpoint
+func ollamaReady() bool {
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(constants.OllamaVersion)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// waitForOllama polls the version endpoint until Ollama is ready or the timeout passes
+func waitForOllama(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if ollamaReady() {
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("Ollama did not become ready within %s", timeout)
+}
@@ -0,0 +1,61 @@
+package backend
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/cluster"
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+// The cluster config's routing policy can replace these
+const (
+	// defaultPreferredAttempts is how many deliveries a preferred node gets before any matching node takes the request
+	defaultPreferredAttempts = 3
+	// defaultPreferredDelay is how long a non-preferred node hands the request back for
+	defaultPreferredDelay = 2 * time.Second
+)
+
+// nodeRegistry is the backend's view of the other nodes, nil if the heartbeat bucket could not be watched
+var nodeRegistry *cluster.NodeRegistry
+
+// placementConstraints reads the require and prefer headers
+func placementConstraints(header nats.Header) (require cluster.Constraints, prefer cluster.Constraints, err error) {
+	if require, err = cluster.ParseConstraints(header.Get("require")); err != nil {
+		return nil, nil, fmt.Errorf("unreadable require header: %v", err)
+	}
+	if prefer, err = cluster.ParseConstraints(header.Get("prefer")); err != nil {
+		return nil, nil, fmt.Errorf("unreadable prefer header: %v", err)
+	}
+	return require, prefer, nil
+}
+
+// matchesPlacement checks the request's constraints against this node's labels
+func matchesPlacement(msg *nats.Msg, require cluster.Constraints, prefer cluster.Constraints) (bool, string) {
+	labels := NodeLabels()
+	if !require.Matches(labels) {
+		return false, fmt.Sprintf("Node does not satisfy %s", require)
+	}
+	if len(prefer) == 0 || prefer.Matches(labels) || nodeRegistry == nil {
+		return true, ""
+	}
+
+	// Give preferred nodes the first few chances, then take it rather than leave it waiting
+	preferredAttempts, preferredDelay := preferredPolicy()
+	if meta, err := msg.Metadata(); err == nil && meta.NumDelivered > uint64(preferredAttempts) {
+		return true, ""
+	}
+
+	model := constants.GetModelRegistry().Resolve(msg.Header.Get("model"))
+	if len(nodeRegistry.Matching(model, append(append(cluster.Constraints{}, require...), prefer...))) == 0 {
+		return true, ""
+	}
+
+	if err := msg.NakWithDelay(preferredDelay); err != nil {
+		node.HandleError(err, node.WARNING, "Failed to hand message back for a preferred node")
+	}
+	return false, fmt.Sprintf("A node matching preferred %s is online", prefer)
+}
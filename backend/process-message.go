@@ -3,11 +3,14 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,14 +18,13 @@ import (
 	"github.com/nats-io/nats.go"
 	"github.com/mtmox/AI-cluster/streams"
 	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/metrics"
 	"github.com/mtmox/AI-cluster/node"
+	"github.com/mtmox/AI-cluster/protocol"
 )
 
-// ChatMessage represents the structure for chat messages
-type ChatMessage struct {
-	Role    string `json:"role"`    // Role can be "user", "assistant", or "system"
-	Content string `json:"content"`
-}
+// ChatMessage is one turn of a conversation, requests carry them in the form Ollama takes
+type ChatMessage = protocol.ChatMessage
 
 // ChatRequest represents the structure for the Ollama API request
 type ChatRequest struct {
@@ -37,22 +39,9 @@ type ChatResponse struct {
 	CreatedAt string      `json:"created_at"`
 	Message   ChatMessage `json:"message"`
 	Done      bool        `json:"done"`
-}
-
-// IncomingMessage represents the structure of incoming messages
-type IncomingMessage struct {
-	ConversationID string        `json:"conversation_id"`
-	ThreadID       int           `json:"thread_id"`
-	Model          string        `json:"model"`
-	SystemPrompt   string        `json:"system_prompt"`
-	Messages       []ChatMessage `json:"messages"`
-}
-
-// NATSMessage represents the structure for messages published to NATS
-type NATSMessage struct {
-	ConversationID string `json:"conversation_id"`
-	ThreadID       int    `json:"thread_id"`
-	Content        string `json:"content"`
+	// EvalCount and EvalDuration (nanoseconds) measure generation speed for the concurrency limiter
+	EvalCount    int   `json:"eval_count"`
+	EvalDuration int64 `json:"eval_duration"`
 }
 
 // Initialize color functions
@@ -72,13 +61,13 @@ func ProcessMessage(js nats.JetStreamContext, logger *log.Logger) {
 		node.HandleError(err, node.ERROR, "Failed to load node settings")
 		return
 	}
+	WatchNodeSettings()
 
 	streamName := "messages"
 	consumerGroup := "message_processors"
 	subject := "in.chat.>"
 
-	modelsInfo, err := constants.ReadModelsInfo(constants.ModelsOutputFile)
-	if err != nil {
+	if err := refreshLocalModels(); err != nil {
 		node.HandleError(err, node.ERROR, "Failed to read models info")
 		return
 	}
@@ -92,23 +81,69 @@ func ProcessMessage(js nats.JetStreamContext, logger *log.Logger) {
 			return false
 		}
 
-		modelName := msg.Header.Get("model")
+		// A request in a version this node cannot read is left for a node that can
+		request, err := protocol.Unmarshal(msg.Data, msg.Header, protocol.TypeChatRequest)
+		var versionErr *protocol.VersionError
+		if errors.As(err, &versionErr) {
+			node.HandleError(err, node.WARNING, fmt.Sprintf("Leaving request %s for a newer node", request.CorrelationID))
+			return false
+		}
+		if err != nil {
+			node.HandleError(err, node.ERROR, "Discarding request that does not decode")
+			if err := msg.Term(); err != nil {
+				node.HandleError(err, node.WARNING, "Failed to discard request")
+			}
+			return false
+		}
+		chat := request.Payload.(*protocol.ChatRequest)
+
+		// Requests may name a model by alias or by tag
+		modelName := constants.GetModelRegistry().Resolve(msg.Header.Get("model"))
 		if modelName == "" {
 			node.HandleError(nil, node.WARNING, "Message without model header, skipping")
 			return false
 		}
 
-		// Check if this node has the required model
-		hasModel := false
-		for _, model := range modelsInfo.Models {
-			if model.Name == modelName {
-				hasModel = true
-				break
+		// Check if this node has the required model, at the pinned digest if one was requested
+		if ok, reason := canServeModel(modelName, pinnedDigest(modelName, msg.Header.Get("digest"))); !ok {
+			node.HandleError(nil, node.WARNING, reason+", skipping")
+			return false
+		}
+
+		// Requests may be limited to nodes with certain labels, or prefer them. Constraints that do not
+		// parse never will on any node, so the request is turned away rather than redelivered.
+		require, prefer, err := placementConstraints(msg.Header)
+		if err != nil {
+			node.HandleError(err, node.ERROR, "Discarding request with unreadable placement")
+			rejectRequest(js, msg, request, modelName, err)
+			return false
+		}
+		if ok, reason := matchesPlacement(msg, require, prefer); !ok {
+			node.HandleError(nil, node.WARNING, reason+", skipping")
+			return false
+		}
+
+		// Throttled requests go back on the stream to be picked up once a token is available.
+		// Frontends hold back their own requester, this also covers any other publisher.
+		requester := msg.Header.Get("requester")
+		if ok, delay := GetRateLimiter().Allow(modelName, requester); !ok {
+			node.HandleError(nil, node.WARNING, fmt.Sprintf("%s for %s is rate limited, requeueing for %s", modelName, requester, delay))
+			if err := msg.NakWithDelay(delay); err != nil {
+				node.HandleError(err, node.WARNING, "Failed to requeue throttled message")
 			}
+			return false
 		}
 
-		if !hasModel {
-			node.HandleError(nil, node.WARNING, fmt.Sprintf("Model %s not found in local models, skipping", modelName))
+		// Each model only runs as many requests at once as it has shown it can sustain
+		limiter := GetConcurrencyLimiter()
+		if !limiter.Acquire(modelName) {
+			GetRateLimiter().Refund(modelName, requester)
+			// Capacity counts the freest model's slots, so requests for a busy one are fetched
+			// routinely and would otherwise sit out the whole ack wait
+			node.HandleError(nil, node.WARNING, fmt.Sprintf("%s is at its concurrency limit, requeueing for %s", modelName, saturatedRetryDelay))
+			if err := msg.NakWithDelay(saturatedRetryDelay); err != nil {
+				node.HandleError(err, node.WARNING, "Failed to requeue message for a saturated model")
+			}
 			return false
 		}
 
@@ -121,114 +156,124 @@ func ProcessMessage(js nats.JetStreamContext, logger *log.Logger) {
 			node.HandleError(nil, node.INFO, fmt.Sprintf("Processing message for model: %s", modelName))
 			node.HandleError(nil, node.INFO, fmt.Sprintf("Incoming Message Data: %s", string(msg.Data)))
 
-			response, convID, threadID, err := sendToLLM(msg.Data, logger)
+			started := time.Now()
+			chatResponse, err := sendToLLM(chat, logger)
 			if err != nil {
+				limiter.Release(modelName, time.Since(started), 0, 0, err)
+				ollamaErrors.Inc("chat")
 				node.HandleError(err, node.ERROR, "Error processing message with LLM")
 				return
 			}
+			limiter.Release(modelName, time.Since(started), chatResponse.EvalCount, time.Duration(chatResponse.EvalDuration), nil)
+			requestDuration.ObserveSince(started, modelName)
+			generatedTokens.Add(float64(chatResponse.EvalCount), modelName)
+			if chatResponse.EvalDuration > 0 {
+				tokensPerSecond.Set(float64(chatResponse.EvalCount)/time.Duration(chatResponse.EvalDuration).Seconds(), modelName)
+			}
+			response := chatResponse.Message.Content
 			
 			node.HandleError(nil, node.SUCCESS, fmt.Sprintf("%s [ConvID: %s, ThreadID: %d] %s",
 				idColor("Response"),
-				idColor(convID),
-				idColor(threadID),
+				idColor(chat.ConversationID),
+				idColor(chat.ThreadID),
 				responseColor(response)))
 
-			natsMsg := &NATSMessage{
-				ConversationID: convID,
-				ThreadID:       threadID,
-				Content:       response,
-			}
-
-			if err := publishMessage(js, natsMsg); err != nil {
+			reply := protocol.Reply(request, &protocol.ChatResponse{
+				ConversationID: chat.ConversationID,
+				ThreadID:       chat.ThreadID,
+				ClientID:       chat.ClientID,
+				Content:        response,
+				NodeID:         node.GetNodeID(),
+			}, protocol.Sender{NodeID: node.GetNodeID()})
+
+			// The response continues the request's trace and shares its message ID, so a redelivered
+			// request that is answered twice only stores one response
+			ctx := streams.WithTraceID(context.Background(), msg.Header.Get(streams.HeaderTraceID))
+			if err := publishMessage(ctx, js, reply, replyCodec(msg.Header), modelName, msg.Header.Get(nats.MsgIdHdr)); err != nil {
 				node.HandleError(err, node.ERROR, "Error publishing message to NATS")
 				return
 			}
+			recordCompletion()
 		}()
 
 		return true
 	}
 
-	subscription, err := streams.DurableGroupPull(
-		js,
-		streamName,
-		subject,
-		consumerGroup,
-		consumerGroup,
-		messageHandler,
-	)
+	// Tasks count as active from the moment they are taken off the queue
+	handler := func(ctx context.Context, msg *nats.Msg) error {
+		tasksLock.Lock()
+		activeTasks++
+		tasksLock.Unlock()
+
+		if !messageHandler(msg) {
+			tasksLock.Lock()
+			activeTasks--
+			tasksLock.Unlock()
+			return streams.ErrNotHandled
+		}
+		return nil
+	}
+
+	consumer, err := streams.Consume(context.Background(), js, streams.ConsumerOptions{
+		Stream:  streamName,
+		Subject: subject,
+		Durable: consumerGroup,
+		Group:   consumerGroup,
+		// Only take what this node can start now, an empty node bucket leaves messages on the
+		// stream rather than fetching and bouncing them
+		Capacity: func() int {
+			if !GetRateLimiter().NodeReady() {
+				return 0
+			}
+			return GetAvailableProcessingSlots()
+		},
+		OnFetch: recordFetch,
+	}, handler)
 	if err != nil {
 		node.HandleError(err, node.FATAL, "Failed to create durable group pull subscription")
 		return
 	}
-
-	// Start a goroutine for message processing
-	go func() {
-		ticker := time.NewTicker(500 * time.Millisecond)
-		for {
-			select {
-			case <-ticker.C:
-				availableSlots := GetAvailableProcessingSlots()
-				max_fetch_messages := 1
-				if availableSlots > 0 {
-					err := FetchMessages(subscription, messageHandler, max_fetch_messages)
-					if err != nil {
-						node.HandleError(err, node.ERROR, "Error fetching messages")
-					}
-				}
-			}
-		}
-	}()
+	metrics.WatchConsumer(consumerGroup, consumer.Subscription())
+	messageSubscription = consumer.Subscription()
 }
 
 func GetAvailableProcessingSlots() int {
 	tasksLock.Lock()
 	defer tasksLock.Unlock()
 
+	if draining {
+		return 0
+	}
+
+	// The adaptive limits decide, the static setting is only a ceiling for the node as a whole
+	available := GetConcurrencyLimiter().Available()
 	settingsLock.RLock()
-	defer settingsLock.RUnlock()
+	if free := settings.MaxParallelRequests - activeTasks; free < available {
+		available = free
+	}
+	settingsLock.RUnlock()
 
-	available := settings.MaxParallelRequests - activeTasks
 	if available < 0 {
 		return 0
 	}
 	return available
 }
 
-func FetchMessages(subscription *nats.Subscription, callback func(msg *nats.Msg) bool, limit int) error {
-	messages, err := subscription.Fetch(limit)
-	if err != nil {
-		if err != nats.ErrTimeout {
-			return fmt.Errorf("error fetching messages: %v", err)
-		}
-		return nil
-	}
-
-	for _, msg := range messages {
-		tasksLock.Lock()
-		activeTasks++
-		tasksLock.Unlock()
-
-		shouldProcess := callback(msg)
-		if !shouldProcess {
-			tasksLock.Lock()
-			activeTasks--
-			tasksLock.Unlock()
-			continue
-		}
-
-		if err := msg.Ack(); err != nil {
-			return fmt.Errorf("error acknowledging message: %v", err)
-		}
+// recordFetch counts every queue fetch by its result
+func recordFetch(count int, err error) {
+	switch {
+	case err != nil:
+		fetchesTotal.Inc("error")
+	case count == 0:
+		fetchesTotal.Inc("empty")
+	default:
+		fetchesTotal.Inc("messages")
+		messagesFetched.Add(float64(count))
 	}
-
-	return nil
 }
 
-func sendToLLM(messageData []byte, logger *log.Logger) (string, string, int, error) {
-	var incomingMsg IncomingMessage
-	if err := json.Unmarshal(messageData, &incomingMsg); err != nil {
-		return "", "", 0, fmt.Errorf("failed to unmarshal message data: %v", err)
-	}
+func sendToLLM(incomingMsg *protocol.ChatRequest, logger *log.Logger) (*ChatResponse, error) {
+	incomingMsg.Model = constants.GetModelRegistry().Resolve(incomingMsg.Model)
 
 	modelManager := GetModelManager()
 	if err := modelManager.CheckAndUnloadModels(incomingMsg.Model); err != nil {
@@ -239,7 +284,7 @@ func sendToLLM(messageData []byte, logger *log.Logger) (string, string, int, err
 		idColor("Parsed Incoming Message:"),
 		idColor(incomingMsg.ConversationID),
 		idColor(incomingMsg.ThreadID),
-		incomingMsg))
+		*incomingMsg))
 
 	messages := make([]ChatMessage, 0)
 
@@ -260,14 +305,14 @@ func sendToLLM(messageData []byte, logger *log.Logger) (string, string, int, err
 
 	requestBody, err := json.Marshal(chatRequest)
 	if err != nil {
-		return "", "", 0, fmt.Errorf("failed to marshal chat request: %v", err)
+		return nil, fmt.Errorf("failed to marshal chat request: %v", err)
 	}
 
 	node.HandleError(nil, node.INFO, fmt.Sprintf("Sending request to Ollama: %s", string(requestBody)))
 
 	resp, err := http.Post(constants.ChatEndpoint, "application/json", bytes.NewBuffer(requestBody))
 	if err != nil {
-		return "", "", 0, fmt.Errorf("failed to send request to Ollama: %v", err)
+		return nil, fmt.Errorf("failed to send request to Ollama: %v", err)
 	}
 	defer resp.Body.Close()
 
@@ -275,28 +320,63 @@ func sendToLLM(messageData []byte, logger *log.Logger) (string, string, int, err
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", "", 0, fmt.Errorf("failed to read response body: %v", err)
+		return nil, fmt.Errorf("failed to read response body: %v", err)
 	}
 
 	var chatResponse ChatResponse
 	if err := json.Unmarshal(body, &chatResponse); err != nil {
-		return "", "", 0, fmt.Errorf("failed to unmarshal response: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	return &chatResponse, nil
+}
+
+// replyCodec answers a request in the codec it was sent with
+func replyCodec(header nats.Header) protocol.Codec {
+	if codec, ok := protocol.CodecFor(header.Get(protocol.HeaderContentType)); ok {
+		return codec
 	}
+	return protocol.JSON
+}
 
-	return chatResponse.Message.Content, incomingMsg.ConversationID, incomingMsg.ThreadID, nil
+// rejectRequest takes a request off the stream for good and tells the requester why
+func rejectRequest(js nats.JetStreamContext, msg *nats.Msg, request *protocol.Envelope, model string, reason error) {
+	if err := msg.Term(); err != nil {
+		node.HandleError(err, node.WARNING, "Failed to discard request")
+	}
+	chat := request.Payload.(*protocol.ChatRequest)
+	reply := protocol.Reply(request, &protocol.ChatResponse{
+		ConversationID: chat.ConversationID,
+		ThreadID:       chat.ThreadID,
+		ClientID:       chat.ClientID,
+		NodeID:         node.GetNodeID(),
+		Error:          reason.Error(),
+	}, protocol.Sender{NodeID: node.GetNodeID()})
+	ctx := streams.WithTraceID(context.Background(), msg.Header.Get(streams.HeaderTraceID))
+	if err := publishMessage(ctx, js, reply, replyCodec(msg.Header), model, msg.Header.Get(nats.MsgIdHdr)); err != nil {
+		node.HandleError(err, node.ERROR, "Failed to tell the requester why its request was discarded")
+	}
 }
 
-func publishMessage(js nats.JetStreamContext, msg *NATSMessage) error {
-	data, err := json.Marshal(msg)
+func publishMessage(ctx context.Context, js nats.JetStreamContext, reply *protocol.Envelope, codec protocol.Codec, model string, requestID string) error {
+	msg := reply.Payload.(*protocol.ChatResponse)
+	data, header, err := protocol.Marshal(reply, codec)
 	if err != nil {
 		return fmt.Errorf("error marshaling message: %v", err)
 	}
 
-	// Send to NATS subject (you can modify the subject as needed)
+	// Responses go to the frontend that sent the request, older frontends share out.chat.<conv>.<thread>
 	subject := fmt.Sprintf("out.chat.%s.%d", msg.ConversationID, msg.ThreadID)
-	
-	err = streams.PublishToNatsOutMessages(js, subject, data)
-	if err != nil {
+	if msg.ClientID != "" && !strings.ContainsAny(msg.ClientID, ".*> ") {
+		subject = fmt.Sprintf("out.chat.%s.%s.%d", msg.ClientID, msg.ConversationID, msg.ThreadID)
+	}
+	header.Set("model", model)
+	if requestID != "" {
+		header.Set(nats.MsgIdHdr, "out."+requestID)
+	}
+
+	publisher := streams.NewPublisher(js, streams.PublisherOptions{NodeID: msg.NodeID, ClientID: msg.ClientID})
+	if _, err := publisher.Publish(ctx, subject, data, header); err != nil {
 		return fmt.Errorf("error publishing to NATS: %v", err)
 	}
 
@@ -0,0 +1,205 @@
+package backend
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mtmox/AI-cluster/cluster"
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/ratelimit"
+)
+
+// maxRequesterBuckets bounds how many requester buckets are kept, beyond it the least recently used go
+const maxRequesterBuckets = 1024
+
+// RateLimiter holds the node wide and per model token buckets configured in node-config.json,
+// and per requester buckets from the cluster config. Each node enforces requester limits on the
+// requests it takes, so a requester spread across several nodes gets each node's rate.
+type RateLimiter struct {
+	node       *ratelimit.Bucket
+	models     map[string]*ratelimit.Bucket
+	requesters map[string]*ratelimit.Bucket
+	// requesterUsed is when each requester's bucket was last asked for
+	requesterUsed map[string]time.Time
+	// requesterRate applies to requesters not in requesterRates, buckets are made on first use
+	requesterRate  int
+	requesterRates map[string]int
+	requesterBurst int
+	mutex          sync.Mutex
+}
+
+var (
+	rateLimiter   *RateLimiter
+	rateLimitOnce sync.Once
+)
+
+// GetRateLimiter returns the singleton instance of RateLimiter
+func GetRateLimiter() *RateLimiter {
+	rateLimitOnce.Do(func() {
+		rateLimiter = &RateLimiter{
+			models:        make(map[string]*ratelimit.Bucket),
+			requesters:    make(map[string]*ratelimit.Bucket),
+			requesterUsed: make(map[string]time.Time),
+		}
+	})
+	return rateLimiter
+}
+
+// nodeRate is the node's requests per minute, falling back to one request per message_delay_ms
+func (s NodeSettings) nodeRate() int {
+	if s.NodeRequestsPerMinute > 0 {
+		return s.NodeRequestsPerMinute
+	}
+	if s.MessageDelayMS > 0 {
+		return 60000 / s.MessageDelayMS
+	}
+	return 0
+}
+
+// Configure rebuilds any bucket whose limit changed, keeping the tokens of the rest
+func (r *RateLimiter) Configure(s NodeSettings) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.node.Matches(s.nodeRate(), s.RateLimitBurst) {
+		r.node = ratelimit.NewBucket(s.nodeRate(), s.RateLimitBurst)
+	}
+
+	for model := range r.models {
+		if _, ok := s.ModelRequestsPerMinute[model]; !ok {
+			delete(r.models, model)
+		}
+	}
+	for model, perMinute := range s.ModelRequestsPerMinute {
+		if bucket, ok := r.models[model]; !ok || !bucket.Matches(perMinute, s.RateLimitBurst) {
+			r.models[model] = ratelimit.NewBucket(perMinute, s.RateLimitBurst)
+		}
+	}
+}
+
+// ConfigureRequesters applies the cluster's requester limits, keeping the tokens of requesters
+// whose limit has not changed
+func (r *RateLimiter) ConfigureRequesters(limits cluster.RateLimits, burst int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.requesterRate = 0
+	if limits.RequesterRequestsPerMinute != nil {
+		r.requesterRate = *limits.RequesterRequestsPerMinute
+	}
+	r.requesterRates = limits.Requesters
+	r.requesterBurst = burst
+	for requester, bucket := range r.requesters {
+		if !bucket.Matches(r.requesterLimit(requester), burst) {
+			delete(r.requesters, requester)
+			delete(r.requesterUsed, requester)
+		}
+	}
+}
+
+// requesterLimit is a requester's requests per minute, the caller holds the mutex
+func (r *RateLimiter) requesterLimit(requester string) int {
+	if perMinute, ok := r.requesterRates[requester]; ok {
+		return perMinute
+	}
+	return r.requesterRate
+}
+
+// requesterBucket returns the requester's bucket, nil when they are unlimited. The caller holds the mutex.
+func (r *RateLimiter) requesterBucket(requester string) *ratelimit.Bucket {
+	if bucket, ok := r.requesters[requester]; ok {
+		r.requesterUsed[requester] = time.Now()
+		return bucket
+	}
+	bucket := ratelimit.NewBucket(r.requesterLimit(requester), r.requesterBurst)
+	if bucket == nil {
+		return nil
+	}
+	// The header names the requester, so anyone can invent new ones. A full bucket is no
+	// different from a new one, so those go first, then the least recently used.
+	if len(r.requesters) >= maxRequesterBuckets {
+		for name, existing := range r.requesters {
+			if state := existing.State(); state.Tokens >= float64(state.Burst) {
+				r.dropRequester(name)
+			}
+		}
+	}
+	for len(r.requesters) >= maxRequesterBuckets {
+		var oldest string
+		var oldestUsed time.Time
+		for name := range r.requesters {
+			if used := r.requesterUsed[name]; oldest == "" || used.Before(oldestUsed) {
+				oldest, oldestUsed = name, used
+			}
+		}
+		r.dropRequester(oldest)
+	}
+	r.requesters[requester] = bucket
+	r.requesterUsed[requester] = time.Now()
+	return bucket
+}
+
+// dropRequester forgets a requester's bucket, the caller holds the mutex
+func (r *RateLimiter) dropRequester(requester string) {
+	delete(r.requesters, requester)
+	delete(r.requesterUsed, requester)
+}
+
+// NodeReady reports whether the node bucket has a token, so fetching is skipped while it is empty
+func (r *RateLimiter) NodeReady() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.node.Ready()
+}
+
+// Allow takes a token from the requester, model and node buckets, or none of them.
+// When throttled it returns how long until the request is worth retrying.
+func (r *RateLimiter) Allow(model, requester string) (bool, time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	requesterBucket := r.requesterBucket(requester)
+	if !requesterBucket.Allow() {
+		return false, requesterBucket.Delay()
+	}
+	modelBucket := r.models[model]
+	if !modelBucket.Allow() {
+		requesterBucket.Refund()
+		return false, modelBucket.Delay()
+	}
+	if !r.node.Allow() {
+		requesterBucket.Refund()
+		modelBucket.Refund()
+		return false, r.node.Delay()
+	}
+	return true, 0
+}
+
+// Refund returns the tokens taken by Allow when the request could not start after all
+func (r *RateLimiter) Refund(model, requester string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requesters[requester].Refund()
+	r.models[model].Refund()
+	r.node.Refund()
+}
+
+// Snapshot returns the throttle state reported in heartbeats
+func (r *RateLimiter) Snapshot() *constants.ThrottleState {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	state := &constants.ThrottleState{
+		Node:   r.node.State(),
+		Models: make(map[string]ratelimit.State, len(r.models)),
+	}
+	state.Throttled = r.node != nil && state.Node.Tokens < 1
+	for model, bucket := range r.models {
+		modelState := bucket.State()
+		state.Models[model] = modelState
+		if modelState.Tokens < 1 {
+			state.Throttled = true
+		}
+	}
+	return state
+}
@@ -5,10 +5,37 @@ import (
 	"log"
 
 	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/cluster"
+	"github.com/mtmox/AI-cluster/nats_server"
+	"github.com/mtmox/AI-cluster/node"
 )
 
 func StartBackend(js nats.JetStreamContext, logger *log.Logger) {
+	// The registry lets a node step aside for better matching nodes on preferred constraints
+	registry, err := cluster.WatchNodes(js)
+	if err != nil {
+		node.HandleError(err, node.WARNING, "Preferred placement constraints will be ignored on this node")
+	}
+	nodeRegistry = registry
+
+	if err := WatchClusterConfig(js); err != nil {
+		node.HandleError(err, node.WARNING, "Running on local settings only")
+	}
+
+	RegisterHealthEndpoints()
 	ProcessMessage(js, logger)
+	WatchModelsFile()
+
+	if err := StartHeartbeat(js); err != nil {
+		node.HandleError(err, node.ERROR, "This node will not appear in the node registry")
+	}
+	if err := ListenForDirectives(nats_server.GetConnection()); err != nil {
+		node.HandleError(err, node.ERROR, "Scheduler directives will be ignored on this node")
+	}
+	if err := ListenForControl(nats_server.GetConnection()); err != nil {
+		node.HandleError(err, node.ERROR, "Remote control is unavailable on this node")
+	}
 
 	select{}
 }
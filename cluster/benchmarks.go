@@ -0,0 +1,103 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+// invalidKeyChars are characters model tags use that KV keys do not allow
+var invalidKeyChars = regexp.MustCompile(`[^-/_=.a-zA-Z0-9]`)
+
+// BenchmarkKey is the KV key for a node's latest benchmark of a model
+func BenchmarkKey(nodeID, model string) string {
+	return nodeID + "." + invalidKeyChars.ReplaceAllString(model, "_")
+}
+
+// PublishBenchmark stores a benchmark summary so routing and placement can read it
+func PublishBenchmark(js nats.JetStreamContext, result constants.BenchmarkResult) error {
+	kv, err := js.KeyValue(constants.BenchmarkBucket)
+	if err != nil {
+		return fmt.Errorf("failed to open benchmark bucket: %v", err)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to marshal benchmark: %v", err)
+	}
+	if _, err := kv.Put(BenchmarkKey(result.NodeID, result.Model), data); err != nil {
+		return fmt.Errorf("failed to publish benchmark: %v", err)
+	}
+	return nil
+}
+
+// BenchmarkBoard keeps the latest benchmark of every model on every node
+type BenchmarkBoard struct {
+	results map[string]constants.BenchmarkResult
+	mutex   sync.RWMutex
+}
+
+// WatchBenchmarks follows the benchmark bucket and returns a board that stays up to date
+func WatchBenchmarks(js nats.JetStreamContext) (*BenchmarkBoard, error) {
+	kv, err := js.KeyValue(constants.BenchmarkBucket)
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Failed to open benchmark bucket")
+		return nil, fmt.Errorf("failed to open benchmark bucket: %v", err)
+	}
+
+	watcher, err := kv.WatchAll()
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Failed to watch benchmark bucket")
+		return nil, fmt.Errorf("failed to watch benchmark bucket: %v", err)
+	}
+
+	board := &BenchmarkBoard{results: make(map[string]constants.BenchmarkResult)}
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry == nil {
+				continue
+			}
+			board.mutex.Lock()
+			if entry.Operation() != nats.KeyValuePut {
+				delete(board.results, entry.Key())
+			} else {
+				var result constants.BenchmarkResult
+				if err := json.Unmarshal(entry.Value(), &result); err != nil {
+					node.HandleError(err, node.WARNING, "Ignoring unreadable benchmark "+entry.Key())
+				} else {
+					board.results[entry.Key()] = result
+				}
+			}
+			board.mutex.Unlock()
+		}
+	}()
+
+	return board, nil
+}
+
+// Get returns a node's latest benchmark of a model
+func (b *BenchmarkBoard) Get(nodeID, model string) (constants.BenchmarkResult, bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	result, ok := b.results[BenchmarkKey(nodeID, model)]
+	return result, ok
+}
+
+// All returns every benchmark, keyed by node ID and then model
+func (b *BenchmarkBoard) All() map[string]map[string]constants.BenchmarkResult {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	all := make(map[string]map[string]constants.BenchmarkResult)
+	for _, result := range b.results {
+		if all[result.NodeID] == nil {
+			all[result.NodeID] = make(map[string]constants.BenchmarkResult)
+		}
+		all[result.NodeID][result.Model] = result
+	}
+	return all
+}
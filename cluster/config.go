@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+// DefaultsConfigKey is the cluster config key every node reads
+const DefaultsConfigKey = "defaults"
+
+// ClusterConfig is the shared configuration kept in the cluster config bucket.
+// Anything left unset keeps the node's own setting.
+type ClusterConfig struct {
+	Streams    map[string]StreamLimits `json:"streams,omitempty"`
+	Routing    RoutingPolicy           `json:"routing"`
+	RateLimits RateLimits              `json:"rate_limits"`
+	// Prompts are added to the frontend's prompt library, replacing built in prompts of the same name
+	Prompts map[string]string `json:"prompts,omitempty"`
+	// ModelPins map a model tag to the digest requests use when they do not pin one themselves
+	ModelPins map[string]string `json:"model_pins,omitempty"`
+}
+
+// StreamLimits overrides the retention limits of a stream
+type StreamLimits struct {
+	MaxAgeSeconds int64 `json:"max_age_seconds,omitempty"`
+	MaxMsgs       int64 `json:"max_msgs,omitempty"`
+}
+
+// RoutingPolicy tunes how long preferred placement holds a request for a better node
+type RoutingPolicy struct {
+	PreferredAttempts *int `json:"preferred_attempts,omitempty"`
+	PreferredDelayMS  *int `json:"preferred_delay_ms,omitempty"`
+}
+
+// RateLimits override the node and requester limits from node-config.json and requester-limits.json
+type RateLimits struct {
+	NodeRequestsPerMinute  *int           `json:"node_requests_per_minute,omitempty"`
+	ModelRequestsPerMinute map[string]int `json:"model_requests_per_minute,omitempty"`
+	Burst                  *int           `json:"burst,omitempty"`
+	// RequesterRequestsPerMinute applies to any requester not listed in Requesters. Frontends
+	// hold requests back at this rate and every backend enforces it on the requests it takes.
+	RequesterRequestsPerMinute *int           `json:"requester_requests_per_minute,omitempty"`
+	Requesters                 map[string]int `json:"requesters,omitempty"`
+}
+
+// NodeConfigKey is the cluster config key holding one node's overrides
+func NodeConfigKey(nodeID string) string {
+	return "node." + invalidKeyChars.ReplaceAllString(nodeID, "_")
+}
+
+// Validate rejects values no node could apply
+func (c *ClusterConfig) Validate() error {
+	for name, limits := range c.Streams {
+		if limits.MaxAgeSeconds < 0 || limits.MaxMsgs < 0 {
+			return fmt.Errorf("stream %s limits cannot be negative", name)
+		}
+	}
+	for name, value := range map[string]*int{
+		"routing.preferred_attempts":                c.Routing.PreferredAttempts,
+		"routing.preferred_delay_ms":                c.Routing.PreferredDelayMS,
+		"rate_limits.node_requests_per_minute":      c.RateLimits.NodeRequestsPerMinute,
+		"rate_limits.burst":                         c.RateLimits.Burst,
+		"rate_limits.requester_requests_per_minute": c.RateLimits.RequesterRequestsPerMinute,
+	} {
+		if value != nil && *value < 0 {
+			return fmt.Errorf("%s cannot be negative", name)
+		}
+	}
+	for model, perMinute := range c.RateLimits.ModelRequestsPerMinute {
+		if perMinute < 0 {
+			return fmt.Errorf("rate limit for model %s cannot be negative", model)
+		}
+	}
+	for requester, perMinute := range c.RateLimits.Requesters {
+		if perMinute < 0 {
+			return fmt.Errorf("rate limit for requester %s cannot be negative", requester)
+		}
+	}
+	return nil
+}
+
+// MaxAge is the stream's configured maximum message age
+func (l StreamLimits) MaxAge() time.Duration {
+	return time.Duration(l.MaxAgeSeconds) * time.Second
+}
+
+// PutConfig validates a config and writes it under key, returning the new revision
+func PutConfig(js nats.JetStreamContext, key string, config ClusterConfig) (uint64, error) {
+	if err := config.Validate(); err != nil {
+		return 0, err
+	}
+	kv, err := js.KeyValue(constants.ClusterConfigBucket)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open cluster config bucket: %v", err)
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal cluster config: %v", err)
+	}
+	revision, err := kv.Put(key, data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write cluster config: %v", err)
+	}
+	return revision, nil
+}
+
+// WatchConfig follows the defaults and this node's override key, calling apply with the merged
+// config and the latest revision once the current values are read and again on every change.
+// A value that does not parse or validate is logged and skipped, leaving the last good config in place.
+func WatchConfig(js nats.JetStreamContext, nodeID string, apply func(config ClusterConfig, revision uint64)) error {
+	kv, err := js.KeyValue(constants.ClusterConfigBucket)
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Failed to open cluster config bucket")
+		return fmt.Errorf("failed to open cluster config bucket: %v", err)
+	}
+
+	watcher, err := kv.WatchAll()
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Failed to watch cluster config bucket")
+		return fmt.Errorf("failed to watch cluster config bucket: %v", err)
+	}
+
+	overrideKey := NodeConfigKey(nodeID)
+	go func() {
+		values := map[string][]byte{}
+		var revision uint64
+		initialised := false
+		for entry := range watcher.Updates() {
+			if entry != nil {
+				if entry.Key() != DefaultsConfigKey && entry.Key() != overrideKey {
+					continue
+				}
+				if entry.Operation() == nats.KeyValuePut {
+					values[entry.Key()] = entry.Value()
+				} else {
+					delete(values, entry.Key())
+				}
+				if entry.Revision() > revision {
+					revision = entry.Revision()
+				}
+			} else {
+				// A nil entry marks the end of the initial values
+				initialised = true
+			}
+			if !initialised {
+				continue
+			}
+
+			config, err := mergeConfig(values[DefaultsConfigKey], values[overrideKey])
+			if err != nil {
+				node.HandleError(err, node.WARNING, fmt.Sprintf("Ignoring cluster config revision %d", revision))
+				continue
+			}
+			apply(config, revision)
+			node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Applied cluster config revision %d", revision))
+		}
+	}()
+
+	node.HandleError(nil, node.SUCCESS, "Watching cluster config for node "+nodeID)
+	return nil
+}
+
+// mergeConfig lays a node's overrides over the defaults, maps are merged key by key
+func mergeConfig(defaults, override []byte) (ClusterConfig, error) {
+	var config ClusterConfig
+	if defaults != nil {
+		if err := json.Unmarshal(defaults, &config); err != nil {
+			return ClusterConfig{}, fmt.Errorf("cluster config defaults are not valid JSON: %v", err)
+		}
+	}
+	if override != nil {
+		if err := json.Unmarshal(override, &config); err != nil {
+			return ClusterConfig{}, fmt.Errorf("cluster config override is not valid JSON: %v", err)
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return ClusterConfig{}, err
+	}
+	return config, nil
+}
@@ -0,0 +1,145 @@
+package cluster
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mtmox/AI-cluster/constants"
+)
+
+// Constraint is a single label condition such as ram>=64 or team=platform
+type Constraint struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+// Constraints is a set of conditions that must all hold
+type Constraints []Constraint
+
+// operators are checked longest first so >= is not read as =
+var operators = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// ParseConstraints reads a comma separated list like "ram>=64, team=platform"
+func ParseConstraints(text string) (Constraints, error) {
+	var constraints Constraints
+	for _, part := range strings.Split(text, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		constraint, err := ParseConstraint(part)
+		if err != nil {
+			return nil, err
+		}
+		constraints = append(constraints, constraint)
+	}
+	return constraints, nil
+}
+
+// ParseConstraint reads one key, operator and value
+func ParseConstraint(text string) (Constraint, error) {
+	for _, op := range operators {
+		if i := strings.Index(text, op); i > 0 {
+			constraint := Constraint{
+				Key:   strings.TrimSpace(text[:i]),
+				Op:    op,
+				Value: strings.TrimSpace(text[i+len(op):]),
+			}
+			if constraint.Key == "" || constraint.Value == "" {
+				break
+			}
+			if op != "=" && op != "!=" {
+				if _, err := strconv.ParseFloat(constraint.Value, 64); err != nil {
+					return Constraint{}, fmt.Errorf("constraint %q compares with %s but %q is not a number", text, op, constraint.Value)
+				}
+			}
+			return constraint, nil
+		}
+	}
+	return Constraint{}, fmt.Errorf("invalid constraint %q, expected key=value or key>=number", text)
+}
+
+// String formats the constraint the way it is written in a request
+func (c Constraint) String() string {
+	return c.Key + c.Op + c.Value
+}
+
+// String formats the constraints as a comma separated list, as used in message headers
+func (cs Constraints) String() string {
+	parts := make([]string, len(cs))
+	for i, c := range cs {
+		parts[i] = c.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// Matches reports whether the labels satisfy the constraint, a missing label only satisfies !=
+func (c Constraint) Matches(labels map[string]string) bool {
+	label, ok := labels[c.Key]
+	if !ok {
+		return c.Op == "!="
+	}
+
+	switch c.Op {
+	case "=":
+		return label == c.Value
+	case "!=":
+		return label != c.Value
+	}
+
+	have, err := strconv.ParseFloat(label, 64)
+	if err != nil {
+		return false
+	}
+	want, _ := strconv.ParseFloat(c.Value, 64)
+	switch c.Op {
+	case ">=":
+		return have >= want
+	case "<=":
+		return have <= want
+	case ">":
+		return have > want
+	case "<":
+		return have < want
+	}
+	return false
+}
+
+// Matches reports whether the labels satisfy every constraint
+func (cs Constraints) Matches(labels map[string]string) bool {
+	for _, c := range cs {
+		if !c.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// CanServe reports whether a node has the model and satisfies the constraints
+func CanServe(heartbeat constants.NodeHeartbeat, model string, require Constraints) bool {
+	if !require.Matches(heartbeat.Labels) {
+		return false
+	}
+	if model == "" {
+		return true
+	}
+	for _, available := range heartbeat.AvailableModels {
+		if available == model {
+			return true
+		}
+	}
+	return false
+}
+
+// Matching returns the online nodes that have the model and satisfy the constraints
+func (r *NodeRegistry) Matching(model string, require Constraints) []constants.NodeHeartbeat {
+	var matching []constants.NodeHeartbeat
+	for _, heartbeat := range r.Online() {
+		if CanServe(heartbeat, model, require) {
+			matching = append(matching, heartbeat)
+		}
+	}
+	return matching
+}
@@ -0,0 +1,189 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+const (
+	// HeartbeatInterval is how often backends write their heartbeat
+	HeartbeatInterval = 5 * time.Second
+	// OfflineAfter is how long a node may go without a heartbeat before it is marked offline
+	OfflineAfter = 3 * HeartbeatInterval
+)
+
+// NodeStatus is the registry's view of a single node
+type NodeStatus struct {
+	Heartbeat constants.NodeHeartbeat `json:"heartbeat"`
+	Online    bool                    `json:"online"`
+	LastSeen  time.Time               `json:"last_seen"`
+}
+
+// NodeRegistry keeps a live view of every backend from the heartbeat bucket
+type NodeRegistry struct {
+	nodes     map[string]*NodeStatus
+	listeners []func()
+	ready     chan struct{}
+	mutex     sync.RWMutex
+}
+
+// WatchNodes starts watching the heartbeat bucket and returns a registry that stays up to date
+func WatchNodes(js nats.JetStreamContext) (*NodeRegistry, error) {
+	kv, err := js.KeyValue(constants.HeartbeatBucket)
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Failed to open heartbeat bucket")
+		return nil, fmt.Errorf("failed to open heartbeat bucket: %v", err)
+	}
+
+	watcher, err := kv.WatchAll()
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Failed to watch heartbeat bucket")
+		return nil, fmt.Errorf("failed to watch heartbeat bucket: %v", err)
+	}
+
+	registry := &NodeRegistry{
+		nodes: make(map[string]*NodeStatus),
+		ready: make(chan struct{}),
+	}
+
+	go func() {
+		initialised := false
+		for entry := range watcher.Updates() {
+			// A nil entry marks the end of the initial values
+			if entry == nil {
+				if !initialised {
+					initialised = true
+					close(registry.ready)
+				}
+				continue
+			}
+			registry.apply(entry)
+		}
+	}()
+
+	// Key expiry does not always produce a delete marker, so sweep on our own clock as well
+	go func() {
+		ticker := time.NewTicker(HeartbeatInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			registry.sweep()
+		}
+	}()
+
+	node.HandleError(nil, node.SUCCESS, "Watching node heartbeats")
+	return registry, nil
+}
+
+func (r *NodeRegistry) apply(entry nats.KeyValueEntry) {
+	r.mutex.Lock()
+	switch entry.Operation() {
+	case nats.KeyValueDelete, nats.KeyValuePurge:
+		if status, ok := r.nodes[entry.Key()]; ok && status.Online {
+			status.Online = false
+			node.HandleError(fmt.Errorf("heartbeat removed"), node.WARNING, fmt.Sprintf("Node %s went offline", entry.Key()))
+		}
+	default:
+		var heartbeat constants.NodeHeartbeat
+		if err := json.Unmarshal(entry.Value(), &heartbeat); err != nil {
+			r.mutex.Unlock()
+			node.HandleError(err, node.WARNING, "Ignoring malformed heartbeat for "+entry.Key())
+			return
+		}
+		status, ok := r.nodes[entry.Key()]
+		if !ok {
+			status = &NodeStatus{}
+			r.nodes[entry.Key()] = status
+		}
+		wasOnline := status.Online
+		status.Heartbeat = heartbeat
+		status.LastSeen = entry.Created()
+		status.Online = time.Since(status.LastSeen) < OfflineAfter
+		if status.Online && !wasOnline {
+			node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Node %s is online", entry.Key()))
+		}
+	}
+	r.mutex.Unlock()
+
+	r.notify()
+}
+
+func (r *NodeRegistry) sweep() {
+	changed := false
+	r.mutex.Lock()
+	for id, status := range r.nodes {
+		if status.Online && time.Since(status.LastSeen) >= OfflineAfter {
+			status.Online = false
+			changed = true
+			node.HandleError(fmt.Errorf("no heartbeat since %s", status.LastSeen.Format(time.RFC3339)), node.WARNING, fmt.Sprintf("Node %s went offline", id))
+		}
+	}
+	r.mutex.Unlock()
+
+	if changed {
+		r.notify()
+	}
+}
+
+// OnChange registers a callback that runs whenever any node's status changes
+func (r *NodeRegistry) OnChange(callback func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.listeners = append(r.listeners, callback)
+}
+
+func (r *NodeRegistry) notify() {
+	r.mutex.RLock()
+	listeners := append([]func(){}, r.listeners...)
+	r.mutex.RUnlock()
+
+	for _, listener := range listeners {
+		listener()
+	}
+}
+
+// WaitReady blocks until the initial heartbeats have been read or the timeout passes
+func (r *NodeRegistry) WaitReady(timeout time.Duration) bool {
+	select {
+	case <-r.ready:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Nodes returns every known node, online or not, ordered by node ID
+func (r *NodeRegistry) Nodes() []NodeStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	statuses := make([]NodeStatus, 0, len(r.nodes))
+	for _, status := range r.nodes {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Heartbeat.NodeID < statuses[j].Heartbeat.NodeID
+	})
+	return statuses
+}
+
+// Online returns the heartbeat of every node currently online, keyed by node ID
+func (r *NodeRegistry) Online() map[string]constants.NodeHeartbeat {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	online := make(map[string]constants.NodeHeartbeat)
+	for id, status := range r.nodes {
+		if status.Online {
+			online[id] = status.Heartbeat
+		}
+	}
+	return online
+}
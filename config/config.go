@@ -0,0 +1,463 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/protocol"
+	"github.com/mtmox/AI-cluster/streams"
+)
+
+// Config is the contents of config.toml. Every field has a default, so the file only needs what differs.
+type Config struct {
+	NATS       NATSConfig              `toml:"nats"`
+	NATSServer NATSServerConfig        `toml:"nats_server"`
+	Ollama     OllamaConfig            `toml:"ollama"`
+	Paths      PathsConfig             `toml:"paths"`
+	Streams    map[string]StreamConfig `toml:"streams"`
+	Node       NodeConfig              `toml:"node"`
+	Setup      SetupConfig             `toml:"setup"`
+}
+
+// NATSConfig is where the queue lives and how to authenticate. At most one of
+// user, creds_file and nkey_file may be set.
+type NATSConfig struct {
+	URL      string `toml:"url"`
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+	// CredsFile is a JWT user credentials file, NKeyFile an NKey seed such as one written by -gen-nats-conf
+	CredsFile string    `toml:"creds_file"`
+	NKeyFile  string    `toml:"nkey_file"`
+	TLS       TLSConfig `toml:"tls"`
+	// ClientID routes a frontend's responses back to it, empty uses the node ID and OS user
+	ClientID string `toml:"client_id"`
+	// Codec encodes the requests this node sends, "json" or "binary". Responses use the request's codec.
+	Codec string `toml:"codec"`
+	// Admin says whether the credentials may manage streams and send control commands, see IsAdmin
+	Admin *bool `toml:"admin"`
+}
+
+// IsAdmin reports whether this node may create and update streams, buckets and consumers other than
+// its own, and send control commands. Unset, only nodes connecting without credentials are admins.
+func (n NATSConfig) IsAdmin() bool {
+	if n.Admin != nil {
+		return *n.Admin
+	}
+	return n.User == "" && n.CredsFile == "" && n.NKeyFile == ""
+}
+
+// TLSConfig names PEM files. CAFile alone verifies the peer, CertFile and KeyFile add our own certificate.
+type TLSConfig struct {
+	CAFile   string `toml:"ca_file"`
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+}
+
+// Enabled reports whether any TLS file is configured
+func (t TLSConfig) Enabled() bool {
+	return t.CAFile != "" || t.CertFile != "" || t.KeyFile != ""
+}
+
+// NATSServerConfig is used when generating nats-server.conf and by the embedded -server mode
+type NATSServerConfig struct {
+	// ConfFile, when set, is loaded by -server instead of building options from the fields below,
+	// so a config written by -gen-nats-conf brings its users and permissions along
+	ConfFile string `toml:"conf_file"`
+	Port     int    `toml:"port"`
+	HTTPPort int    `toml:"http_port"`
+	StoreDir string `toml:"store_dir"`
+	// MaxMem and MaxFile use the server's size syntax, e.g. 4G
+	MaxMem  string `toml:"max_mem"`
+	MaxFile string `toml:"max_file"`
+	// LogFile defaults to nats_server/nats-server.log under the root
+	LogFile string    `toml:"log_file"`
+	TLS     TLSConfig `toml:"tls"`
+	// FrontendClients are the nats.client_id of every frontend. -gen-nats-conf gives each one its
+	// own user, which can only read its own responses.
+	FrontendClients []string `toml:"frontend_clients"`
+}
+
+// OllamaConfig is how the backend reaches, or starts, Ollama
+type OllamaConfig struct {
+	URL    string `toml:"url"`
+	Binary string `toml:"binary"`
+}
+
+// PathsConfig places data files, logs and databases. Empty directories fall back to the root.
+type PathsConfig struct {
+	Root    string `toml:"root"`
+	DataDir string `toml:"data_dir"`
+	LogDir  string `toml:"log_dir"`
+	DBDir   string `toml:"db_dir"`
+}
+
+// StreamConfig overrides limits of a stream defined in streams.Streams
+type StreamConfig struct {
+	MaxAge  time.Duration `toml:"max_age"`
+	MaxMsgs int64         `toml:"max_msgs"`
+}
+
+// NodeConfig holds the defaults written into a new node-config.json. Existing files keep their values.
+type NodeConfig struct {
+	// MaxParallelRequests of 0 means half the node's RAM in GB
+	MaxParallelRequests   int               `toml:"max_parallel_requests"`
+	MessageDelayMS        int               `toml:"message_delay_ms"`
+	MaxLoadedModels       int               `toml:"max_loaded_models"`
+	ManageOllama          bool              `toml:"manage_ollama"`
+	NodeRequestsPerMinute int               `toml:"node_requests_per_minute"`
+	RateLimitBurst        int               `toml:"rate_limit_burst"`
+	Labels                map[string]string `toml:"labels"`
+}
+
+// SetupConfig is read by the scripts in setup/
+type SetupConfig struct {
+	ControlServer string `toml:"control_server"`
+}
+
+// envOverrides maps environment variables onto the settings they replace
+var envOverrides = map[string]func(c *Config, value string) error{
+	"AI_CLUSTER_NATS_URL":      func(c *Config, v string) error { c.NATS.URL = v; return nil },
+	"AI_CLUSTER_NATS_USER":     func(c *Config, v string) error { c.NATS.User = v; return nil },
+	"AI_CLUSTER_NATS_PASSWORD": func(c *Config, v string) error { c.NATS.Password = v; return nil },
+	"AI_CLUSTER_NATS_CREDS":    func(c *Config, v string) error { c.NATS.CredsFile = v; return nil },
+	"AI_CLUSTER_NATS_NKEY":     func(c *Config, v string) error { c.NATS.NKeyFile = v; return nil },
+	"AI_CLUSTER_CLIENT_ID":     func(c *Config, v string) error { c.NATS.ClientID = v; return nil },
+	"AI_CLUSTER_OLLAMA_URL":    func(c *Config, v string) error { c.Ollama.URL = v; return nil },
+	"AI_CLUSTER_OLLAMA_BINARY": func(c *Config, v string) error { c.Ollama.Binary = v; return nil },
+	"AI_CLUSTER_ROOT":          func(c *Config, v string) error { c.Paths.Root = v; return nil },
+	"AI_CLUSTER_DATA_DIR":      func(c *Config, v string) error { c.Paths.DataDir = v; return nil },
+	"AI_CLUSTER_LOG_DIR":       func(c *Config, v string) error { c.Paths.LogDir = v; return nil },
+	"AI_CLUSTER_DB_DIR":        func(c *Config, v string) error { c.Paths.DBDir = v; return nil },
+	"AI_CLUSTER_MANAGE_OLLAMA": func(c *Config, v string) error {
+		manage, err := strconv.ParseBool(v)
+		c.Node.ManageOllama = manage
+		return err
+	},
+}
+
+// clientIDChars are the characters a client ID may hold, so it works as a subject token and consumer name
+const clientIDChars = `A-Za-z0-9_-`
+
+var (
+	// ValidClientID matches a usable client ID
+	ValidClientID        = regexp.MustCompile(`^[` + clientIDChars + `]+$`)
+	invalidClientIDChars = regexp.MustCompile(`[^` + clientIDChars + `]`)
+)
+
+// SanitizeClientID turns any string into a valid client ID by replacing the characters it cannot hold
+func SanitizeClientID(id string) string {
+	return invalidClientIDChars.ReplaceAllString(id, "_")
+}
+
+// ConfigEnv names the environment variable that points at a config file
+const ConfigEnv = "AI_CLUSTER_CONFIG"
+
+var (
+	current     = Defaults()
+	currentLock sync.RWMutex
+)
+
+// Defaults returns the built-in configuration, matching the values compiled into constants
+func Defaults() *Config {
+	return &Config{
+		NATS: NATSConfig{URL: constants.NatsURL, Codec: protocol.JSON.Name()},
+		NATSServer: NATSServerConfig{
+			Port:     4222,
+			HTTPPort: 8222,
+			StoreDir: "/tmp/nats-jetstream",
+			MaxMem:   "4G",
+			MaxFile:  "40G",
+		},
+		Ollama: OllamaConfig{URL: constants.OllamaURL, Binary: constants.OllamaBinary},
+		Paths:  PathsConfig{Root: constants.RootDirectory},
+		Node: NodeConfig{
+			MessageDelayMS:  500,
+			MaxLoadedModels: 2,
+			RateLimitBurst:  1,
+		},
+		Setup: SetupConfig{ControlServer: "192.168.1.16:8090"},
+	}
+}
+
+// DefaultPath is where config.toml is looked for when neither -config nor AI_CLUSTER_CONFIG is set
+func DefaultPath() string {
+	if root := os.Getenv("AI_CLUSTER_ROOT"); root != "" {
+		return filepath.Join(expandPath(root), "config.toml")
+	}
+	return filepath.Join(constants.RootDirectory, "config.toml")
+}
+
+// Load layers the defaults, the config file and environment variables, in that order.
+// An empty path uses AI_CLUSTER_CONFIG or the default location, where a missing file is not an error.
+func Load(path string) (*Config, error) {
+	cfg := Defaults()
+
+	explicit := path != ""
+	if !explicit {
+		path = os.Getenv(ConfigEnv)
+		explicit = path != ""
+	}
+	if path == "" {
+		path = DefaultPath()
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if _, err := toml.DecodeFile(path, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+	} else if explicit || !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read config %s: %v", path, err)
+	}
+
+	for name, apply := range envOverrides {
+		if value, ok := os.LookupEnv(name); ok {
+			if err := apply(cfg, value); err != nil {
+				return nil, fmt.Errorf("invalid %s=%q: %v", name, value, err)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// expandPath resolves ~ and environment variables so the file can say ~/AI-cluster
+func expandPath(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		path = filepath.Join(os.Getenv("HOME"), path[2:])
+	}
+	return os.ExpandEnv(path)
+}
+
+// Validate rejects a configuration the cluster cannot run with
+func (c *Config) Validate() error {
+	if err := checkURL("nats.url", c.NATS.URL, "nats", "tls", "ws", "wss"); err != nil {
+		return err
+	}
+	if err := c.NATS.validateAuth(); err != nil {
+		return err
+	}
+	if _, err := protocol.CodecByName(c.NATS.Codec); err != nil {
+		return fmt.Errorf("nats.codec: %v", err)
+	}
+	if c.NATS.ClientID != "" && !ValidClientID.MatchString(c.NATS.ClientID) {
+		return fmt.Errorf("nats.client_id may only contain letters, digits, _ and -, got %q", c.NATS.ClientID)
+	}
+	if err := validateTLS("nats_server.tls", &c.NATSServer.TLS); err != nil {
+		return err
+	}
+	for _, client := range c.NATSServer.FrontendClients {
+		if !ValidClientID.MatchString(client) {
+			return fmt.Errorf("nats_server.frontend_clients may only contain letters, digits, _ and -, got %q", client)
+		}
+	}
+	if c.NATSServer.Port <= 0 || c.NATSServer.HTTPPort < 0 {
+		return fmt.Errorf("nats_server ports must be positive")
+	}
+	c.NATSServer.StoreDir = expandPath(c.NATSServer.StoreDir)
+	c.NATSServer.LogFile = expandPath(c.NATSServer.LogFile)
+	if err := checkFile("nats_server.conf_file", &c.NATSServer.ConfFile); err != nil {
+		return err
+	}
+	for name, size := range map[string]string{"nats_server.max_mem": c.NATSServer.MaxMem, "nats_server.max_file": c.NATSServer.MaxFile} {
+		if _, err := ParseSize(size); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	if err := checkURL("ollama.url", c.Ollama.URL, "http", "https"); err != nil {
+		return err
+	}
+	if c.Ollama.Binary == "" {
+		return fmt.Errorf("ollama.binary cannot be empty")
+	}
+
+	c.Paths.Root = expandPath(c.Paths.Root)
+	if !filepath.IsAbs(c.Paths.Root) {
+		return fmt.Errorf("paths.root must be absolute, got %q", c.Paths.Root)
+	}
+	for name, dir := range map[string]*string{"paths.data_dir": &c.Paths.DataDir, "paths.log_dir": &c.Paths.LogDir, "paths.db_dir": &c.Paths.DBDir} {
+		*dir = expandPath(*dir)
+		if *dir != "" && !filepath.IsAbs(*dir) {
+			return fmt.Errorf("%s must be absolute, got %q", name, *dir)
+		}
+	}
+
+	for name, stream := range c.Streams {
+		if !knownStream(name) {
+			return fmt.Errorf("streams.%s does not match any stream", name)
+		}
+		if stream.MaxAge < 0 || stream.MaxMsgs < 0 {
+			return fmt.Errorf("streams.%s limits cannot be negative", name)
+		}
+	}
+
+	n := c.Node
+	if n.MaxParallelRequests < 0 || n.MessageDelayMS < 0 || n.NodeRequestsPerMinute < 0 || n.RateLimitBurst < 0 {
+		return fmt.Errorf("node settings cannot be negative")
+	}
+	if n.MaxLoadedModels < 1 {
+		return fmt.Errorf("node.max_loaded_models must be at least 1, got %d", n.MaxLoadedModels)
+	}
+	return nil
+}
+
+// LogPath is where the NATS server logs, nats_server/nats-server.log under the root unless configured
+func (s NATSServerConfig) LogPath() string {
+	if s.LogFile != "" {
+		return s.LogFile
+	}
+	return filepath.Join(constants.RootDirectory, "nats_server", "nats-server.log")
+}
+
+// sizeUnits are the suffixes nats-server accepts for sizes
+var sizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// ParseSize reads sizes such as 512M or 40G, a bare number is bytes
+func ParseSize(size string) (int64, error) {
+	text := strings.ToUpper(strings.TrimSpace(size))
+	text = strings.TrimSuffix(text, "B")
+	unit := ""
+	if text != "" {
+		if last := text[len(text)-1:]; sizeUnits[last] != 0 {
+			unit, text = last, text[:len(text)-1]
+		}
+	}
+	value, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return value * sizeUnits[unit], nil
+}
+
+// validateAuth allows one way of authenticating and checks that its files exist
+func (n *NATSConfig) validateAuth() error {
+	methods := 0
+	for _, set := range []bool{n.User != "", n.CredsFile != "", n.NKeyFile != ""} {
+		if set {
+			methods++
+		}
+	}
+	if methods > 1 {
+		return fmt.Errorf("nats: set only one of user, creds_file and nkey_file")
+	}
+	if n.Password != "" && n.User == "" {
+		return fmt.Errorf("nats.password needs nats.user")
+	}
+	for name, file := range map[string]*string{"nats.creds_file": &n.CredsFile, "nats.nkey_file": &n.NKeyFile} {
+		if err := checkFile(name, file); err != nil {
+			return err
+		}
+	}
+	return validateTLS("nats.tls", &n.TLS)
+}
+
+// validateTLS expands and checks the TLS files, a certificate needs its key
+func validateTLS(name string, t *TLSConfig) error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("%s needs both cert_file and key_file", name)
+	}
+	for field, file := range map[string]*string{"ca_file": &t.CAFile, "cert_file": &t.CertFile, "key_file": &t.KeyFile} {
+		if err := checkFile(name+"."+field, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFile expands an optional path in place and makes sure it exists
+func checkFile(name string, path *string) error {
+	if *path == "" {
+		return nil
+	}
+	*path = expandPath(*path)
+	if _, err := os.Stat(*path); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+func checkURL(name, raw string, schemes ...string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid URL: %v", name, err)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("%s %q has no host", name, raw)
+	}
+	for _, scheme := range schemes {
+		if parsed.Scheme == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %q must use one of %s", name, raw, strings.Join(schemes, ", "))
+}
+
+func knownStream(name string) bool {
+	for _, stream := range streams.Streams {
+		if stream.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply validates the configuration and pushes it into constants and streams
+func (c *Config) Apply() error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	constants.NatsURL = c.NATS.URL
+	constants.SetOllamaURL(c.Ollama.URL)
+	constants.OllamaBinary = c.Ollama.Binary
+
+	dataDir, logDir, dbDir := c.Paths.DataDir, c.Paths.LogDir, c.Paths.DBDir
+	if dataDir == "" {
+		dataDir = c.Paths.Root
+	}
+	if logDir == "" {
+		logDir = filepath.Join(dataDir, "node")
+	}
+	if dbDir == "" {
+		dbDir = filepath.Join(dataDir, "node")
+	}
+	constants.SetPaths(c.Paths.Root, dataDir, logDir, dbDir)
+
+	for i := range streams.Streams {
+		if override, ok := c.Streams[streams.Streams[i].Name]; ok {
+			if override.MaxAge > 0 {
+				streams.Streams[i].MaxAge = override.MaxAge
+			}
+			if override.MaxMsgs > 0 {
+				streams.Streams[i].MaxMsgs = override.MaxMsgs
+			}
+		}
+	}
+
+	currentLock.Lock()
+	current = c
+	currentLock.Unlock()
+	return nil
+}
+
+// Get returns the configuration in effect, the defaults until Apply has run
+func Get() *Config {
+	currentLock.RLock()
+	defer currentLock.RUnlock()
+	return current
+}
@@ -4,9 +4,27 @@ package constants
 import (
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const (
+	// HeartbeatBucket is the KV bucket every backend writes its heartbeat to, keyed by node ID
+	HeartbeatBucket = "node_heartbeats"
+	// DirectiveSubject is where the scheduler sends placement directives, suffixed with the node ID
+	DirectiveSubject = "scheduler.directive"
+	// DriftSubject is where the scheduler announces tags that have different digests across nodes
+	DriftSubject = "cluster.drift"
+	// ControlSubject is where admin commands are sent, suffixed with the node ID
+	ControlSubject = "node.control"
+	// BenchmarkBucket is the KV bucket holding the latest benchmark summary per node and model
+	BenchmarkBucket = "model_benchmarks"
+	// ClusterConfigBucket holds the shared cluster config under "defaults" and per node overrides under "node.<id>"
+	ClusterConfigBucket = "cluster_config"
+)
+
+// The addresses and paths below are defaults, config.Apply replaces them from config.toml,
+// environment variables and command line flags before anything connects or opens a file
+var (
 	// NatsURL is the computer running the queue
 	NatsURL = "nats://192.168.1.140:4222"
 	// OllamaURL is the base URL for the API
@@ -19,11 +37,75 @@ const (
 	LoadedModels = OllamaURL + "/api/ps"
 	PullModels = OllamaURL + "/api/pull"
 	DeleteModels = OllamaURL + "/api/delete"
+	ShowModel = OllamaURL + "/api/show"
+	// OllamaVersion answers once the Ollama server is ready for requests
+	OllamaVersion = OllamaURL + "/api/version"
+	// OllamaBinary is the executable launched when the backend supervises Ollama itself
+	OllamaBinary = "ollama"
 )
 
 var (
-	// ModelsOutputFile is the path to the output JSON file
-	ModelsOutputFile = filepath.Join(os.ExpandEnv("$HOME"), "AI-cluster", "constants", "models.json")
-	ErrorDatabase = filepath.Join(os.ExpandEnv("$HOME"), "AI-cluster", "node", "errors.db")
+	// BuildVersion is set at build time with -ldflags "-X github.com/mtmox/AI-cluster/constants.BuildVersion=..."
+	BuildVersion = "dev"
+
 	RootDirectory = filepath.Join(os.Getenv("HOME"), "AI-cluster")
+
+	// ModelsOutputFile is the path to the output JSON file
+	ModelsOutputFile = filepath.Join(RootDirectory, "constants", "models.json")
+	// ModelAliasesFile maps friendly model names such as coder-large to concrete tags
+	ModelAliasesFile = filepath.Join(RootDirectory, "constants", "model-aliases.json")
+	// NodeIdentityFile holds this node's persistent ID, name and labels
+	NodeIdentityFile = filepath.Join(RootDirectory, "node", "identity.json")
+	// NodeConfigFile holds this node's hot-reloadable backend settings
+	NodeConfigFile = filepath.Join(RootDirectory, "backend", "node-config.json")
+	// NodeLogFile is the process-wide log written once node.Initialize has run
+	NodeLogFile = filepath.Join(RootDirectory, "node", "node.log")
+	// ErrorCounterFile keeps error IDs unique across restarts
+	ErrorCounterFile = filepath.Join(RootDirectory, "node", "error_counter.json")
+	ErrorDatabase = filepath.Join(RootDirectory, "node", "errors.db")
+	// BenchmarkDatabase keeps every benchmark run, the KV bucket only holds the latest
+	BenchmarkDatabase = filepath.Join(RootDirectory, "node", "benchmarks.db")
+	// AuditDatabase records every control command a node received
+	AuditDatabase = filepath.Join(RootDirectory, "node", "audit.db")
+	// RequesterLimitsFile sets how many requests per minute each requester may submit from a frontend
+	RequesterLimitsFile = filepath.Join(RootDirectory, "frontend", "requester-limits.json")
+	// ControlKeyFile holds the shared secret control commands are signed with
+	ControlKeyFile = filepath.Join(RootDirectory, "node", "control.key")
 )
+
+// SetOllamaURL points every Ollama endpoint at a new base URL
+func SetOllamaURL(url string) {
+	OllamaURL = strings.TrimRight(url, "/")
+	ListModelsEndpoint = OllamaURL + "/api/tags"
+	ChatEndpoint = OllamaURL + "/api/chat"
+	GenerateEndpoint = OllamaURL + "/api/generate"
+	LoadedModels = OllamaURL + "/api/ps"
+	PullModels = OllamaURL + "/api/pull"
+	DeleteModels = OllamaURL + "/api/delete"
+	ShowModel = OllamaURL + "/api/show"
+	OllamaVersion = OllamaURL + "/api/version"
+}
+
+// SetPaths moves the data files under dataDir, the log under logDir and the databases under dbDir
+func SetPaths(root, dataDir, logDir, dbDir string) {
+	RootDirectory = root
+	ModelsOutputFile = filepath.Join(dataDir, "constants", "models.json")
+	ModelAliasesFile = filepath.Join(dataDir, "constants", "model-aliases.json")
+	NodeIdentityFile = filepath.Join(dataDir, "node", "identity.json")
+	NodeConfigFile = filepath.Join(dataDir, "backend", "node-config.json")
+	ErrorCounterFile = filepath.Join(dataDir, "node", "error_counter.json")
+	RequesterLimitsFile = filepath.Join(dataDir, "frontend", "requester-limits.json")
+	ControlKeyFile = filepath.Join(dataDir, "node", "control.key")
+	NodeLogFile = filepath.Join(logDir, "node.log")
+	ErrorDatabase = filepath.Join(dbDir, "errors.db")
+	BenchmarkDatabase = filepath.Join(dbDir, "benchmarks.db")
+	AuditDatabase = filepath.Join(dbDir, "audit.db")
+}
+
+// BenchmarkPrompts is the standard suite, from a short answer to a long generation over a longer prompt
+var BenchmarkPrompts = []string{
+	"Reply with the single word: ready",
+	"Explain in three sentences how a hash map handles collisions.",
+	"Write a Go function that parses a CSV line into fields, handling quoted fields that contain commas, and explain how it works.",
+	"Summarise the following text in one paragraph.\n\n" + strings.Repeat("Distributed systems trade consistency, availability and partition tolerance against each other, and every practical design picks which guarantee to weaken when the network misbehaves. ", 20),
+}
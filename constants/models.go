@@ -31,25 +31,35 @@ type ModelsResponse struct {
 	Models []Model `json:"models"`
 }
 
-func QueryAndWriteModels() error {
+// QueryModels asks Ollama which models it currently has
+func QueryModels() (*ModelsResponse, error) {
 	// Make the API request using the constant
 	resp, err := http.Get(ListModelsEndpoint)
 	if err != nil {
-		return fmt.Errorf("error making API request: %v", err)
+		return nil, fmt.Errorf("error making API request: %v", err)
 	}
 	defer resp.Body.Close()
 
 	// Read the response body
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("error reading response body: %v", err)
+		return nil, fmt.Errorf("error reading response body: %v", err)
 	}
 
 	// Parse the JSON response
 	var modelsResp ModelsResponse
 	err = json.Unmarshal(body, &modelsResp)
 	if err != nil {
-		return fmt.Errorf("error parsing JSON response: %v", err)
+		return nil, fmt.Errorf("error parsing JSON response: %v", err)
+	}
+
+	return &modelsResp, nil
+}
+
+func QueryAndWriteModels() error {
+	modelsResp, err := QueryModels()
+	if err != nil {
+		return err
 	}
 
 	// Write the models to a JSON file
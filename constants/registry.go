@@ -0,0 +1,257 @@
+package constants
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ModelCapabilities describes what a model can do, as reported by Ollama's show endpoint
+type ModelCapabilities struct {
+	ContextLength  int64  `json:"context_length"`
+	Template       string `json:"template"`
+	Vision         bool   `json:"vision"`
+	Tools          bool   `json:"tools"`
+	ParameterCount int64  `json:"parameter_count"`
+}
+
+// showResponse is the subset of /api/show we care about
+type showResponse struct {
+	Template      string                 `json:"template"`
+	Details       Details                `json:"details"`
+	ModelInfo     map[string]interface{} `json:"model_info"`
+	ProjectorInfo map[string]interface{} `json:"projector_info"`
+	Capabilities  []string               `json:"capabilities"`
+}
+
+// QueryModelCapabilities asks the local Ollama for a model's capabilities
+func QueryModelCapabilities(modelName string) (*ModelCapabilities, error) {
+	requestBody, err := json.Marshal(map[string]string{"model": modelName})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling show request: %v", err)
+	}
+
+	resp, err := http.Post(ShowModel, "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("error making API request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("show request for %s failed: %s", modelName, resp.Status)
+	}
+
+	var show showResponse
+	if err := json.Unmarshal(body, &show); err != nil {
+		return nil, fmt.Errorf("error parsing JSON response: %v", err)
+	}
+
+	caps := &ModelCapabilities{
+		Template: show.Template,
+		// Older Ollama versions have no capabilities list, so fall back to the template and projector
+		Vision: len(show.ProjectorInfo) > 0,
+		Tools:  strings.Contains(show.Template, ".Tools"),
+	}
+	for _, capability := range show.Capabilities {
+		switch capability {
+		case "vision":
+			caps.Vision = true
+		case "tools":
+			caps.Tools = true
+		}
+	}
+
+	for key, value := range show.ModelInfo {
+		number, ok := value.(float64)
+		if !ok {
+			continue
+		}
+		if strings.HasSuffix(key, ".context_length") {
+			caps.ContextLength = int64(number)
+		}
+		if key == "general.parameter_count" {
+			caps.ParameterCount = int64(number)
+		}
+	}
+	if caps.ParameterCount == 0 {
+		caps.ParameterCount = parseParameterSize(show.Details.ParameterSize)
+	}
+
+	return caps, nil
+}
+
+// parseParameterSize turns strings like "7.6B" or "500M" into a parameter count
+func parseParameterSize(size string) int64 {
+	size = strings.TrimSpace(strings.ToUpper(size))
+	if size == "" {
+		return 0
+	}
+
+	multiplier := 1.0
+	switch size[len(size)-1] {
+	case 'K':
+		multiplier = 1e3
+	case 'M':
+		multiplier = 1e6
+	case 'B':
+		multiplier = 1e9
+	case 'T':
+		multiplier = 1e12
+	}
+	if multiplier != 1.0 {
+		size = size[:len(size)-1]
+	}
+
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil {
+		return 0
+	}
+	return int64(value * multiplier)
+}
+
+// ModelRegistry tracks known models, their capabilities and friendly aliases
+type ModelRegistry struct {
+	models  map[string]ModelCapabilities
+	aliases map[string]string
+	mutex   sync.RWMutex
+}
+
+var (
+	modelRegistry *ModelRegistry
+	registryOnce  sync.Once
+)
+
+// GetModelRegistry returns the singleton ModelRegistry, empty until LoadAliases is called
+func GetModelRegistry() *ModelRegistry {
+	registryOnce.Do(func() {
+		modelRegistry = &ModelRegistry{
+			models:  make(map[string]ModelCapabilities),
+			aliases: make(map[string]string),
+		}
+	})
+	return modelRegistry
+}
+
+// LoadAliases reads an alias file of the form {"coder-large": "qwen2.5-coder:32b"}
+func (r *ModelRegistry) LoadAliases(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var aliases map[string]string
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return fmt.Errorf("error parsing aliases: %v", err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for alias, tag := range aliases {
+		r.aliases[alias] = tag
+	}
+	return nil
+}
+
+// SetAlias maps a friendly name to a concrete tag
+func (r *ModelRegistry) SetAlias(alias, tag string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.aliases[alias] = tag
+}
+
+// Aliases returns a copy of the alias table
+func (r *ModelRegistry) Aliases() map[string]string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	aliases := make(map[string]string, len(r.aliases))
+	for alias, tag := range r.aliases {
+		aliases[alias] = tag
+	}
+	return aliases
+}
+
+// Resolve returns the concrete tag for an alias, or the name unchanged if it is already a tag
+func (r *ModelRegistry) Resolve(name string) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if tag, ok := r.aliases[name]; ok {
+		return tag
+	}
+	return name
+}
+
+// SetCapabilities records the capabilities for a concrete tag
+func (r *ModelRegistry) SetCapabilities(tag string, caps ModelCapabilities) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.models[tag] = caps
+}
+
+// Capabilities looks up capabilities by tag or alias
+func (r *ModelRegistry) Capabilities(name string) (ModelCapabilities, bool) {
+	tag := r.Resolve(name)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	caps, ok := r.models[tag]
+	return caps, ok
+}
+
+// Model sort orders understood by ModelRegistry.List
+const (
+	SortByName          = "Name"
+	SortByContextLength = "Context length"
+	SortByParameters    = "Parameters"
+)
+
+// List returns tags and aliases whose capabilities pass the filter, ordered by sortBy
+func (r *ModelRegistry) List(filter func(ModelCapabilities) bool, sortBy string) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	capsFor := make(map[string]ModelCapabilities)
+	for tag, caps := range r.models {
+		capsFor[tag] = caps
+	}
+	for alias, tag := range r.aliases {
+		if caps, ok := r.models[tag]; ok {
+			capsFor[alias] = caps
+		}
+	}
+
+	var names []string
+	for name, caps := range capsFor {
+		if filter == nil || filter(caps) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		a, b := capsFor[names[i]], capsFor[names[j]]
+		switch sortBy {
+		case SortByContextLength:
+			if a.ContextLength != b.ContextLength {
+				return a.ContextLength > b.ContextLength
+			}
+		case SortByParameters:
+			if a.ParameterCount != b.ParameterCount {
+				return a.ParameterCount > b.ParameterCount
+			}
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
@@ -1,6 +1,111 @@
-
 package constants
 
+import (
+	"time"
+
+	"github.com/mtmox/AI-cluster/protocol"
+	"github.com/mtmox/AI-cluster/ratelimit"
+)
+
 type ConfigSyncModels struct {
-	Name  string  `json:"name"`
+	Name         string            `json:"name"`
+	Capabilities ModelCapabilities `json:"capabilities"`
+}
+
+// NodeLoadReport is the part of a heartbeat the scheduler needs to know what it can place where
+type NodeLoadReport struct {
+	NodeID          string            `json:"node_id"`
+	LoadedModels    []string          `json:"loaded_models"`
+	AvailableModels []string          `json:"available_models"`
+	ModelDigests    map[string]string `json:"model_digests"`
+	ActiveTasks     int               `json:"active_tasks"`
+	MaxParallel     int               `json:"max_parallel"`
+	MaxLoadedModels int               `json:"max_loaded_models"`
+	MemoryTotal     uint64            `json:"memory_total"`
+	MemoryUsed      uint64            `json:"memory_used"`
+	Timestamp       time.Time         `json:"timestamp"`
+}
+
+// NodeHeartbeat is written by each backend to the heartbeat bucket every few seconds
+type NodeHeartbeat struct {
+	NodeLoadReport
+	Name            string            `json:"name,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	IP              string            `json:"ip"`
+	Version         string            `json:"version"`
+	CPUPercent      float64           `json:"cpu_percent"`
+	OllamaReachable bool              `json:"ollama_reachable"`
+	Draining        bool              `json:"draining"`
+	// Ready mirrors /readyz, NotReady lists the checks that failed
+	Ready    bool     `json:"ready"`
+	NotReady []string `json:"not_ready,omitempty"`
+	// RequestsPerMinute is how many requests this node completed over the last minute
+	RequestsPerMinute int       `json:"requests_per_minute"`
+	LastError         string    `json:"last_error,omitempty"`
+	LastErrorAt       time.Time `json:"last_error_at,omitempty"`
+	// Concurrency is the adaptive per-model request limit, MaxParallel is their combined total
+	Concurrency map[string]ModelConcurrency `json:"concurrency,omitempty"`
+	Throttle    *ThrottleState              `json:"throttle,omitempty"`
+	// ConfigRevision is the cluster config bucket revision this node has applied
+	ConfigRevision uint64 `json:"config_revision,omitempty"`
+	// Protocol is the range of message versions the node reads, absent from nodes older than versioning
+	Protocol protocol.VersionRange `json:"protocol"`
+}
+
+// ThrottleState shows how close a node's rate limits are to holding requests back
+type ThrottleState struct {
+	// Throttled is true while any bucket is empty and matching requests are left queued
+	Throttled bool                       `json:"throttled"`
+	Node      ratelimit.State            `json:"node"`
+	Models    map[string]ratelimit.State `json:"models,omitempty"`
+}
+
+// ModelConcurrency is the adaptive concurrency state of one model on a node
+type ModelConcurrency struct {
+	Limit           int     `json:"limit"`
+	Active          int     `json:"active"`
+	TokensPerSecond float64 `json:"tokens_per_second"`
+	LatencyMS       float64 `json:"latency_ms_per_token"`
+	Errors          int     `json:"errors"`
+}
+
+// PlacementDirective tells a backend to load, unload or re-pull a model
+type PlacementDirective struct {
+	NodeID string `json:"node_id"`
+	Action string `json:"action"` // "load", "unload" or "pull"
+	Model  string `json:"model"`
+	Reason string `json:"reason"`
+}
+
+// DirectiveResult is the reply a backend sends when a directive was sent as a request
+type DirectiveResult struct {
+	NodeID string `json:"node_id"`
+	Action string `json:"action"`
+	Model  string `json:"model"`
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Benchmark is filled in for benchmark directives
+	Benchmark *BenchmarkResult `json:"benchmark,omitempty"`
+}
+
+const (
+	DirectiveLoad      = "load"
+	DirectiveUnload    = "unload"
+	DirectivePull      = "pull"
+	DirectiveBenchmark = "benchmark"
+)
+
+// BenchmarkResult summarises one run of the prompt suite for a model on a node
+type BenchmarkResult struct {
+	NodeID string `json:"node_id"`
+	Model  string `json:"model"`
+	Digest string `json:"digest"`
+	// PromptTokensPerSecond is how fast the prompt was evaluated, GenerationTokensPerSecond how fast tokens came out
+	PromptTokensPerSecond     float64   `json:"prompt_tokens_per_second"`
+	GenerationTokensPerSecond float64   `json:"generation_tokens_per_second"`
+	LoadSeconds               float64   `json:"load_seconds"`
+	MemoryBytes               uint64    `json:"memory_bytes"`
+	VRAMBytes                 uint64    `json:"vram_bytes"`
+	Prompts                   int       `json:"prompts"`
+	RunAt                     time.Time `json:"run_at"`
 }
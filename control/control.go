@@ -0,0 +1,171 @@
+package control
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/constants"
+)
+
+// Commands a node accepts on its control subject
+const (
+	ReloadSettings = "reload_settings"
+	Drain          = "drain"
+	Resume         = "resume"
+	RestartBackend = "restart_backend"
+	SetMaxParallel = "set_max_parallel"
+	UnloadAll      = "unload_all"
+	Diagnostics    = "diagnostics"
+)
+
+// Commands lists every control command in the order the admin view offers them
+var Commands = []string{Diagnostics, ReloadSettings, Drain, Resume, SetMaxParallel, UnloadAll, RestartBackend}
+
+// MaxCommandAge is how old a signed command may be before it is rejected as a replay
+const MaxCommandAge = time.Minute
+
+// Command is a signed instruction sent to a single node
+type Command struct {
+	Command   string            `json:"command"`
+	Args      map[string]string `json:"args,omitempty"`
+	Issuer    string            `json:"issuer"`
+	IssuedAt  time.Time         `json:"issued_at"`
+	Nonce     string            `json:"nonce"`
+	Signature string            `json:"signature"`
+}
+
+// Reply is the acknowledgement a node sends back for every command
+type Reply struct {
+	NodeID  string          `json:"node_id"`
+	Command string          `json:"command"`
+	OK      bool            `json:"ok"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Subject returns the control subject for a node
+func Subject(nodeID string) string {
+	return fmt.Sprintf("%s.%s", constants.ControlSubject, nodeID)
+}
+
+// LoadKey reads the shared secret used to sign and verify commands
+func LoadKey() ([]byte, error) {
+	data, err := os.ReadFile(constants.ControlKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read control key: %v", err)
+	}
+	key := []byte(strings.TrimSpace(string(data)))
+	if len(key) == 0 {
+		return nil, fmt.Errorf("control key file %s is empty", constants.ControlKeyFile)
+	}
+	return key, nil
+}
+
+// payload is the canonical form of a command that gets signed
+func (c *Command) payload() []byte {
+	keys := make([]string, 0, len(c.Args))
+	for k := range c.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%s\n%s\n%s\n", c.Command, c.Issuer, c.IssuedAt.UTC().Format(time.RFC3339Nano), c.Nonce)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", k, c.Args[k])
+	}
+	return []byte(b.String())
+}
+
+// Sign fills in the timestamp, nonce and signature of a command
+func (c *Command) Sign(key []byte) error {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	c.Nonce = hex.EncodeToString(nonce)
+	c.IssuedAt = time.Now()
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(c.payload())
+	c.Signature = hex.EncodeToString(mac.Sum(nil))
+	return nil
+}
+
+// Verifier checks command signatures and rejects replays
+type Verifier struct {
+	key   []byte
+	seen  map[string]time.Time
+	mutex sync.Mutex
+}
+
+// NewVerifier creates a Verifier for the given key
+func NewVerifier(key []byte) *Verifier {
+	return &Verifier{key: key, seen: make(map[string]time.Time)}
+}
+
+// Verify returns an error if the command is unsigned, forged, stale or replayed
+func (v *Verifier) Verify(c *Command) error {
+	signature, err := hex.DecodeString(c.Signature)
+	if err != nil || len(signature) == 0 {
+		return fmt.Errorf("command is not signed")
+	}
+
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write(c.payload())
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	age := time.Since(c.IssuedAt)
+	if age > MaxCommandAge || age < -MaxCommandAge {
+		return fmt.Errorf("command issued at %s is outside the allowed window", c.IssuedAt.Format(time.RFC3339))
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for nonce, at := range v.seen {
+		if time.Since(at) > 2*MaxCommandAge {
+			delete(v.seen, nonce)
+		}
+	}
+	if _, ok := v.seen[c.Nonce]; ok {
+		return fmt.Errorf("command nonce already used")
+	}
+	v.seen[c.Nonce] = time.Now()
+	return nil
+}
+
+// Send signs a command, sends it to a node and waits for its acknowledgement
+func Send(nc *nats.Conn, key []byte, nodeID string, cmd Command, timeout time.Duration) (*Reply, error) {
+	if err := cmd.Sign(key); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal command: %v", err)
+	}
+
+	msg, err := nc.Request(Subject(nodeID), data, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("no reply from node %s: %v", nodeID, err)
+	}
+
+	var reply Reply
+	if err := json.Unmarshal(msg.Data, &reply); err != nil {
+		return nil, fmt.Errorf("invalid reply from node %s: %v", nodeID, err)
+	}
+	return &reply, nil
+}
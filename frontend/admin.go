@@ -0,0 +1,113 @@
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+
+	"github.com/mtmox/AI-cluster/cluster"
+	"github.com/mtmox/AI-cluster/config"
+	"github.com/mtmox/AI-cluster/control"
+	"github.com/mtmox/AI-cluster/nats_server"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+// createAdminTab builds the view used to send control commands to individual nodes
+func createAdminTab(registry *cluster.NodeRegistry) fyne.CanvasObject {
+	if registry == nil {
+		return widget.NewLabel("Node registry unavailable, admin commands are disabled")
+	}
+
+	if !config.Get().NATS.IsAdmin() {
+		return widget.NewLabel("Admin commands need admin NATS credentials, connect with the admin seed or set nats.admin")
+	}
+
+	key, err := control.LoadKey()
+	if err != nil {
+		node.HandleError(err, node.WARNING, "Admin view disabled")
+		return widget.NewLabel(fmt.Sprintf("Admin commands are disabled: %v", err))
+	}
+
+	// Node IDs behind the names shown in the selector
+	nodeIDs := make(map[string]string)
+
+	nodeSelector := widget.NewSelect([]string{}, nil)
+	refreshNodes := func() {
+		var names []string
+		for _, status := range registry.Nodes() {
+			name := fmt.Sprintf("%s (%s)", status.Heartbeat.Name, status.Heartbeat.NodeID)
+			nodeIDs[name] = status.Heartbeat.NodeID
+			names = append(names, name)
+		}
+		nodeSelector.Options = names
+		nodeSelector.Refresh()
+	}
+	refreshNodes()
+	registry.OnChange(refreshNodes)
+
+	commandSelector := widget.NewSelect(control.Commands, nil)
+	commandSelector.SetSelected(control.Diagnostics)
+
+	valueEntry := widget.NewEntry()
+	valueEntry.SetPlaceHolder("value for set_max_parallel")
+
+	output := widget.NewMultiLineEntry()
+	output.Wrapping = fyne.TextWrapWord
+
+	sendButton := widget.NewButton("Send", func() {
+		nodeID, ok := nodeIDs[nodeSelector.Selected]
+		if !ok {
+			output.SetText("Select a node first")
+			return
+		}
+
+		cmd := control.Command{
+			Command: commandSelector.Selected,
+			Issuer:  node.GetIdentity().DisplayName(),
+		}
+		if cmd.Command == control.SetMaxParallel {
+			cmd.Args = map[string]string{"value": valueEntry.Text}
+		}
+
+		output.SetText(fmt.Sprintf("Sending %s to %s...", cmd.Command, nodeID))
+		go func() {
+			reply, err := control.Send(nats_server.GetConnection(), key, nodeID, cmd, 30*time.Second)
+			if err != nil {
+				node.HandleError(err, node.ERROR, fmt.Sprintf("Control command %s to %s failed", cmd.Command, nodeID))
+				output.SetText(err.Error())
+				return
+			}
+			output.SetText(formatReply(reply))
+		}()
+	})
+
+	form := container.NewVBox(
+		container.NewHBox(widget.NewLabel("Node:"), nodeSelector),
+		container.NewHBox(widget.NewLabel("Command:"), commandSelector),
+		container.NewHBox(widget.NewLabel("Value:"), valueEntry),
+		sendButton,
+	)
+
+	return container.NewBorder(form, nil, nil, nil, container.NewScroll(output))
+}
+
+func formatReply(reply *control.Reply) string {
+	status := "FAILED"
+	if reply.OK {
+		status = "OK"
+	}
+	text := fmt.Sprintf("[%s] %s on %s: %s", status, reply.Command, reply.NodeID, reply.Message)
+
+	if len(reply.Data) > 0 {
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, reply.Data, "", "  "); err == nil {
+			text += "\n\n" + pretty.String()
+		}
+	}
+	return text
+}
@@ -21,6 +21,9 @@ var threadCounter int = 1
 var sendToAllThreads bool = false
 var modelSelector *widget.Select
 var promptSelector *widget.Select
+var digestEntry *widget.Entry
+var requireEntry *widget.Entry
+var preferEntry *widget.Entry
 
 func createChatTab(js nats.JetStreamContext) fyne.CanvasObject {
 	if len(conversations) == 0 {
@@ -46,27 +49,36 @@ func createChatTab(js nats.JetStreamContext) fyne.CanvasObject {
 	})
 	
 	// Create the prompt selector
-	var promptNames []string
-	for name := range constants.SystemPrompts {
-		promptNames = append(promptNames, name)
-	}
-	promptSelector = widget.NewSelect(promptNames, func(selected string) {
+	promptSelector = widget.NewSelect(promptNames(), func(selected string) {
 		// Handle prompt selection here if needed
 		if selected != "" {
 			// You can use the selected prompt here
-			// constants.SystemPrompts[selected] will give you the prompt content
+			// systemPrompt(selected) will give you the prompt content
 		}
 	})
 	
-	// Function to update the model selector options
-	updateModelSelector := func() {
-		var names []string
-		for name := range modelNames {
-			names = append(names, name)
-		}
-		modelSelector.Options = names
-		modelSelector.Refresh()
-	}
+	// Narrow and order the model list by what the models can do
+	capabilitySelector := widget.NewSelect([]string{filterAll, filterVision, filterTools, filterLongContext}, func(selected string) {
+		capabilityFilter = selected
+		updateModelSelector()
+	})
+	capabilitySelector.SetSelected(filterAll)
+
+	sortSelector := widget.NewSelect([]string{constants.SortByName, constants.SortByContextLength, constants.SortByParameters}, func(selected string) {
+		modelSortOrder = selected
+		updateModelSelector()
+	})
+	sortSelector.SetSelected(constants.SortByName)
+
+	// Optional digest pin so only nodes with exactly these weights answer
+	digestEntry = widget.NewEntry()
+	digestEntry.SetPlaceHolder("any digest")
+
+	// Optional label constraints, e.g. ram>=64, team=platform
+	requireEntry = widget.NewEntry()
+	requireEntry.SetPlaceHolder("any node")
+	preferEntry = widget.NewEntry()
+	preferEntry.SetPlaceHolder("no preference")
 	
 	// Initial update of the selector
 	updateModelSelector()
@@ -161,7 +173,7 @@ func createChatTab(js nats.JetStreamContext) fyne.CanvasObject {
 
 	newConversationButton := widget.NewButton("New Conversation", func() {
 		newConversation := Conversation{
-			ID:            strconv.Itoa(len(conversations) + 1),
+			ID:            newConversationID(),
 			Threads:       []Thread{},
 			ThreadCounter: 0,
 		}
@@ -269,6 +281,11 @@ func createChatTab(js nats.JetStreamContext) fyne.CanvasObject {
 	// Create a container for both selectors
 	selectorsContainer := container.NewHBox(
 		container.NewHBox(widget.NewLabel("Model:"), modelSelector),
+		container.NewHBox(widget.NewLabel("Capability:"), capabilitySelector),
+		container.NewHBox(widget.NewLabel("Sort:"), sortSelector),
+		container.NewHBox(widget.NewLabel("Digest:"), digestEntry),
+		container.NewHBox(widget.NewLabel("Require:"), requireEntry),
+		container.NewHBox(widget.NewLabel("Prefer:"), preferEntry),
 		container.NewHBox(widget.NewLabel("Prompt:"), promptSelector),
 	)
 
@@ -310,7 +327,7 @@ func sendMessage(js nats.JetStreamContext, messageBar *widget.Entry, conversatio
     if message != "" {
         if selectedConversation == nil {
             newConversation := Conversation{
-                ID:            strconv.Itoa(len(conversations) + 1),
+                ID:            newConversationID(),
                 Threads:       []Thread{},
                 ThreadCounter: 0,
             }
@@ -331,6 +348,16 @@ func sendMessage(js nats.JetStreamContext, messageBar *widget.Entry, conversatio
         }
 
         newMessage := Message{Role: "User", Content: message}
+        require, prefer, placementErr := checkPlacement(modelSelector.Selected, digestEntry.Text, requireEntry.Text, preferEntry.Text)
+        if placementErr != nil && modelSelector.Selected != "" && promptSelector.Selected != "" {
+            // Fail fast rather than leave a request no node will ever take. The turn is not kept,
+            // so the thread sent next holds no question without an answer, and the error is only shown.
+            if currentThreadIndex < len(selectedConversation.Threads) {
+                updateChatOutput(chatOutput, selectedConversation.Threads[currentThreadIndex].Messages)
+            }
+            appendMessage(chatOutput, "Error", placementErr.Error())
+            return
+        }
         if sendToAllThreads {
             for i := range selectedConversation.Threads {
                 selectedConversation.Threads[i].Messages = append(selectedConversation.Threads[i].Messages, newMessage)
@@ -342,19 +369,17 @@ func sendMessage(js nats.JetStreamContext, messageBar *widget.Entry, conversatio
                         selectedConversation.Threads[i],
                         modelSelector.Selected,
                         promptSelector.Selected,
+                        digestEntry.Text,
                     )
                     if err != nil {
                         node.HandleError(err, node.ERROR, "Error formatting message for NATS")
                         continue
                     }
-                    
+
+                    natsMsg.Require, natsMsg.Prefer = require.String(), prefer.String()
+
                     if js != nil {
-                        err = sendMessageToNATS(js, natsMsg)
-                        if err != nil {
-                            node.HandleError(err, node.ERROR, "Error sending message to NATS")
-                        } else {
-                            node.HandleError(nil, node.SUCCESS, "Message successfully sent to NATS")
-                        }
+                        queueMessageForNATS(js, natsMsg)
                     }
                 }
             }
@@ -373,16 +398,13 @@ func sendMessage(js nats.JetStreamContext, messageBar *widget.Entry, conversatio
                         selectedConversation.Threads[currentThreadIndex],
                         modelSelector.Selected,
                         promptSelector.Selected,
+                        digestEntry.Text,
                     )
                     if err != nil {
                         node.HandleError(err, node.ERROR, "Error formatting message for NATS")
                     } else if js != nil {
-                        err = sendMessageToNATS(js, natsMsg)
-                        if err != nil {
-                            node.HandleError(err, node.ERROR, "Error sending message to NATS")
-                        } else {
-                            node.HandleError(nil, node.SUCCESS, "Message successfully sent to NATS")
-                        }
+                        natsMsg.Require, natsMsg.Prefer = require.String(), prefer.String()
+                        queueMessageForNATS(js, natsMsg)
                     }
                 }
                 
@@ -0,0 +1,86 @@
+package frontend
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+
+	"github.com/mtmox/AI-cluster/config"
+	"github.com/mtmox/AI-cluster/node"
+	"github.com/mtmox/AI-cluster/protocol"
+)
+
+// legacyResponseConsumer is the shared durable every frontend used before responses were
+// routed per client. It overlaps the per client consumers on the work queue stream.
+const legacyResponseConsumer = "out_chat_messages"
+
+var (
+	client     string
+	clientOnce sync.Once
+)
+
+// clientID identifies this frontend, backends send its responses to out.chat.<client>.>.
+// It stays the same across restarts so responses that arrive while it is closed are kept.
+func clientID() string {
+	clientOnce.Do(func() {
+		client = config.Get().NATS.ClientID
+		if client == "" {
+			client = config.SanitizeClientID(node.GetNodeID() + "-" + currentRequester())
+		}
+	})
+	return client
+}
+
+// ConnectOptions are the NATS options a frontend connects with. Replies come to _INBOX.<client>,
+// the only inbox its generated user may subscribe to.
+func ConnectOptions() []nats.Option {
+	return []nats.Option{nats.CustomInboxPrefix("_INBOX." + clientID())}
+}
+
+// newConversationID returns an ID no other frontend will generate
+func newConversationID() string {
+	return nuid.Next()
+}
+
+// responseSubject is where this frontend receives responses
+func responseSubject() string {
+	return fmt.Sprintf("out.chat.%s.>", clientID())
+}
+
+// legacyResponseConsumerExists reports whether the shared response consumer is still on the server.
+// While it is, the work queue stream refuses per client consumers. Frontends leave it alone as older
+// ones may still read it, -reconcile deletes it once every frontend has been upgraded.
+func legacyResponseConsumerExists(js nats.JetStreamContext) bool {
+	_, err := js.ConsumerInfo("messages", legacyResponseConsumer)
+	return err == nil
+}
+
+// requestVersion is the newest message version every live backend reads. While a backend from
+// before versioning is online requests go out in the legacy format, though its responses still
+// go to the shared out.chat.<conv>.<thread> subject, so backends are upgraded before frontends.
+func requestVersion() int {
+	if nodeRegistry == nil {
+		return protocol.CurrentVersion
+	}
+	var peers []protocol.VersionRange
+	for _, heartbeat := range nodeRegistry.Online() {
+		peers = append(peers, heartbeat.Protocol)
+	}
+	version, err := protocol.Negotiate(protocol.Supported, peers...)
+	if err != nil {
+		node.HandleError(err, node.WARNING, "Sending requests in the current protocol version")
+		return protocol.CurrentVersion
+	}
+	return version
+}
+
+// requestCodec encodes requests as nats.codec in config.toml says
+func requestCodec() protocol.Codec {
+	codec, err := protocol.CodecByName(config.Get().NATS.Codec)
+	if err != nil {
+		return protocol.JSON
+	}
+	return codec
+}
@@ -0,0 +1,91 @@
+package frontend
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/cluster"
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/nats_server"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+var (
+	clusterConfig     cluster.ClusterConfig
+	clusterRevision   uint64
+	clusterConfigLock sync.RWMutex
+)
+
+// watchClusterConfig applies the shared prompt library, requester limits and stream limits as they change
+func watchClusterConfig(js nats.JetStreamContext) error {
+	return cluster.WatchConfig(js, node.GetNodeID(), func(config cluster.ClusterConfig, revision uint64) {
+		clusterConfigLock.Lock()
+		clusterConfig = config
+		clusterRevision = revision
+		clusterConfigLock.Unlock()
+
+		configureSubmitBucket()
+		updatePromptSelector()
+
+		for name, limits := range config.Streams {
+			if err := nats_server.UpdateStreamLimits(js, name, limits.MaxAge(), limits.MaxMsgs); err != nil {
+				node.HandleError(err, node.WARNING, "Failed to apply cluster limits to stream "+name)
+			}
+		}
+	})
+}
+
+// clusterRateLimits returns the rate limits from the cluster config
+func clusterRateLimits() cluster.RateLimits {
+	clusterConfigLock.RLock()
+	defer clusterConfigLock.RUnlock()
+	return clusterConfig.RateLimits
+}
+
+// configRevision is the cluster config revision this frontend is running
+func configRevision() uint64 {
+	clusterConfigLock.RLock()
+	defer clusterConfigLock.RUnlock()
+	return clusterRevision
+}
+
+// systemPrompt looks a prompt up in the cluster's library first, then the built in prompts
+func systemPrompt(name string) (string, bool) {
+	clusterConfigLock.RLock()
+	defer clusterConfigLock.RUnlock()
+	if prompt, ok := clusterConfig.Prompts[name]; ok {
+		return prompt, true
+	}
+	prompt, ok := constants.SystemPrompts[name]
+	return prompt, ok
+}
+
+// promptNames lists the built in and cluster prompts in name order
+func promptNames() []string {
+	clusterConfigLock.RLock()
+	defer clusterConfigLock.RUnlock()
+
+	seen := make(map[string]bool)
+	var names []string
+	for name := range constants.SystemPrompts {
+		seen[name] = true
+		names = append(names, name)
+	}
+	for name := range clusterConfig.Prompts {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// updatePromptSelector refreshes the prompt options after the library changes
+func updatePromptSelector() {
+	if promptSelector != nil {
+		promptSelector.Options = promptNames()
+		promptSelector.Refresh()
+	}
+}
@@ -2,20 +2,25 @@
 package frontend
 
 import (
+	"context"
 	"strconv"
 	"encoding/json"
 	"log"
 	"fmt"
 	"strings"
+	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/widget"
 
 	"github.com/nats-io/nats.go"
 
+	"github.com/mtmox/AI-cluster/cluster"
+	"github.com/mtmox/AI-cluster/metrics"
 	"github.com/mtmox/AI-cluster/streams"
 	"github.com/mtmox/AI-cluster/constants"
 	"github.com/mtmox/AI-cluster/node"
+	"github.com/mtmox/AI-cluster/protocol"
 )
 
 type Conversation struct {
@@ -29,26 +34,8 @@ type Thread struct {
 	Messages []Message
 }
 
-type Message struct {
-	Role  string
-	Content string
-}
-
-// NATSMessage represents the format we'll send to the NATS queue
-type NATSMessage struct {
-	ConversationID string    `json:"conversation_id"`
-	ThreadID       int       `json:"thread_id"`
-	Model         string     `json:"model"`
-	SystemPrompt  string     `json:"system_prompt"`
-	Messages      []Message  `json:"messages"`
-}
-
-// NATSResponse represents the format we receive from the NATS queue
-type NATSResponse struct {
-	ConversationID string `json:"conversation_id"`
-	ThreadID       int    `json:"thread_id"`
-	Content        string `json:"content"`
-}
+// Message is one turn of a thread, in the form requests carry it
+type Message = protocol.ChatMessage
 
 func updateConversationList(list *widget.List, conversations []Conversation) {
 	list.Length = func() int { return len(conversations) }
@@ -84,24 +71,51 @@ func appendMessage(output *widget.Entry, role, content string) {
 	output.SetText(currentText + newMessage)
 }
 
+// Capability filters offered next to the model selector
+const (
+	filterAll         = "All"
+	filterVision      = "Vision"
+	filterTools       = "Tools"
+	filterLongContext = "Long context"
+)
+
+// longContextThreshold is the context length a model needs to pass the long context filter
+const longContextThreshold = 32768
+
+var capabilityFilter = filterAll
+var modelSortOrder = constants.SortByName
+
+func modelPassesFilter(caps constants.ModelCapabilities) bool {
+	switch capabilityFilter {
+	case filterVision:
+		return caps.Vision
+	case filterTools:
+		return caps.Tools
+	case filterLongContext:
+		return caps.ContextLength >= longContextThreshold
+	default:
+		return true
+	}
+}
+
 // Add this function to update the model selector from outside
 func updateModelSelector() {
 	if modelSelector != nil {
-		var names []string
-		for name := range modelNames {
-			names = append(names, name)
-		}
+		names := constants.GetModelRegistry().List(modelPassesFilter, modelSortOrder)
 		modelSelector.Options = names
 		modelSelector.Refresh()
 	}
 }
 
+// configSyncModels reads the models backends announce. Each frontend has its own durable so every
+// one of them sees every model.
 func configSyncModels(js nats.JetStreamContext, logger *log.Logger) error {
-	subject := "config.sync.models"
-	durable := "config_sync_models"
+	subject := "models.sync"
+	durable := "config_sync_models_" + clientID()
 	
-	_, err := streams.DurablePull(js, "nodes", subject, durable, func(msg *nats.Msg) {
+	_, err := streams.DurablePull(context.Background(), js, "models", subject, durable, func(ctx context.Context, msg *nats.Msg) error {
 		populateModels(msg, logger)
+		return nil
 	})
 	if err != nil {
 		node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to set up consumer for subject: %s", subject))
@@ -121,33 +135,38 @@ func populateModels(msg *nats.Msg, logger *log.Logger) {
 		return
 	}
 	
+	// Capabilities are refreshed on every sync so the selector reflects the latest node reports
+	constants.GetModelRegistry().SetCapabilities(model.Name, model.Capabilities)
+
 	if !modelNames[model.Name] {
 		modelNames[model.Name] = true
 		logger.Printf("Added new model: %s", model.Name)
-		updateModelSelector()
 		node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Successfully added new model: %s", model.Name))
 	}
+	updateModelSelector()
 }
 
-func formatMessageForNATS(conv *Conversation, thread Thread, model, promptName string) (*NATSMessage, error) {
+func formatMessageForNATS(conv *Conversation, thread Thread, model, promptName, digest string) (*protocol.ChatRequest, error) {
 	if conv == nil {
 		err := fmt.Errorf("conversation cannot be nil")
 		node.HandleError(err, node.ERROR, "Attempted to format message with nil conversation")
 		return nil, err
 	}
 
-	systemPrompt, exists := constants.SystemPrompts[promptName]
+	prompt, exists := systemPrompt(promptName)
 	if !exists {
 		err := fmt.Errorf("system prompt %s not found", promptName)
 		node.HandleError(err, node.ERROR, fmt.Sprintf("System prompt not found: %s", promptName))
 		return nil, err
 	}
 
-	natsMsg := &NATSMessage{
+	natsMsg := &protocol.ChatRequest{
 		ConversationID: conv.ID,
 		ThreadID:       thread.ID,
-		Model:         model,
-		SystemPrompt:  systemPrompt,
+		ClientID:       clientID(),
+		Model:         constants.GetModelRegistry().Resolve(model),
+		Digest:        strings.TrimSpace(digest),
+		SystemPrompt:  prompt,
 		Messages:      thread.Messages,
 	}
 
@@ -155,43 +174,103 @@ func formatMessageForNATS(conv *Conversation, thread Thread, model, promptName s
 	return natsMsg, nil
 }
 
-func sendMessageToNATS(js nats.JetStreamContext, msg *NATSMessage) error {
-	data, err := json.Marshal(msg)
+// checkPlacement parses the constraint entries and makes sure a live node can take the request,
+// holding the pinned digest when there is one
+func checkPlacement(model, digest, requireText, preferText string) (cluster.Constraints, cluster.Constraints, error) {
+	require, err := cluster.ParseConstraints(requireText)
+	if err != nil {
+		return nil, nil, err
+	}
+	prefer, err := cluster.ParseConstraints(preferText)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Without a registry there is nothing to check against, so let the backends decide
+	if nodeRegistry == nil || !nodeRegistry.WaitReady(2*time.Second) {
+		return require, prefer, nil
+	}
+
+	model = constants.GetModelRegistry().Resolve(model)
+	matching := nodeRegistry.Matching(model, require)
+	if len(matching) == 0 {
+		requestsRejected.Inc()
+		if len(require) == 0 {
+			return nil, nil, fmt.Errorf("no live node has %s", model)
+		}
+		return nil, nil, fmt.Errorf("no live node has %s and satisfies %s", model, require)
+	}
+
+	// Backends only take a pinned request when their digest starts with the pin, so one no node
+	// holds would be redelivered forever
+	digest = strings.TrimSpace(digest)
+	if digest == "" {
+		return require, prefer, nil
+	}
+	for _, heartbeat := range matching {
+		if strings.HasPrefix(heartbeat.ModelDigests[model], digest) {
+			return require, prefer, nil
+		}
+	}
+	requestsRejected.Inc()
+	return nil, nil, fmt.Errorf("no live node has %s at digest %s", model, digest)
+}
+
+func sendMessageToNATS(js nats.JetStreamContext, msg *protocol.ChatRequest) error {
+	// The same turn of a thread always has the same ID, so a resubmitted request is dropped as a
+	// duplicate, and the response comes back with it
+	requestID := fmt.Sprintf("%s.%s.%d.%d", msg.ClientID, msg.ConversationID, msg.ThreadID, len(msg.Messages))
+	envelope := protocol.NewEnvelope(msg, requestVersion(), requestID, protocol.Sender{NodeID: node.GetNodeID(), ClientID: msg.ClientID})
+	data, header, err := protocol.Marshal(envelope, requestCodec())
 	if err != nil {
 		node.HandleError(err, node.ERROR, "Error marshaling message for NATS")
 		return fmt.Errorf("error marshaling message: %v", err)
 	}
 
-	subject := fmt.Sprintf("in.chat.%s.%d", msg.ConversationID, msg.ThreadID)
-	header := make(nats.Header)
+	// Requests carry the client so the response comes back to this frontend only
+	subject := fmt.Sprintf("in.chat.%s.%s.%d", msg.ClientID, msg.ConversationID, msg.ThreadID)
 	header.Set("model", msg.Model)
+	header.Set("requester", currentRequester())
+	header.Set(nats.MsgIdHdr, requestID)
+	if msg.Require != "" {
+		header.Set("require", msg.Require)
+	}
+	if msg.Prefer != "" {
+		header.Set("prefer", msg.Prefer)
+	}
+	if msg.Digest != "" {
+		header.Set("digest", msg.Digest)
+	}
 	
-	err = streams.PublishToNatsWithHeader(js, subject, data, header)
-	if err != nil {
+	publisher := streams.NewPublisher(js, streams.PublisherOptions{ClientID: msg.ClientID})
+	if _, err := publisher.Publish(context.Background(), subject, data, header); err != nil {
 		node.HandleError(err, node.ERROR, "Error publishing message to NATS")
 		return fmt.Errorf("error publishing to NATS: %v", err)
 	}
 
+	requestsSubmitted.Inc(msg.Model)
 	node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Successfully published message to NATS subject: %s", subject))
 	return nil
 }
 
 func populateAssistants(msg *nats.Msg, logger *log.Logger) {
 	parts := strings.Split(msg.Subject, ".")
-	if len(parts) != 4 {
+	if len(parts) != 5 || parts[2] != clientID() {
 		err := fmt.Errorf("invalid subject format: %s", msg.Subject)
 		node.HandleError(err, node.ERROR, "Invalid NATS subject format")
 		logger.Printf("Invalid subject format: %s", msg.Subject)
 		return
 	}
 
-	var response NATSResponse
-	err := json.Unmarshal(msg.Data, &response)
+	// Nothing else can take this client's responses, so one that cannot be read is only logged
+	envelope, err := protocol.Unmarshal(msg.Data, msg.Header, protocol.TypeChatResponse)
 	if err != nil {
 		node.HandleError(err, node.ERROR, "Error unmarshaling NATS response")
 		logger.Printf("Error unmarshaling response: %v", err)
 		return
 	}
+	response := envelope.Payload.(*protocol.ChatResponse)
+	responsesReceived.Inc(response.NodeID)
 
 	var targetConv *Conversation
 	for i := range conversations {
@@ -223,16 +302,27 @@ func populateAssistants(msg *nats.Msg, logger *log.Logger) {
 		return
 	}
 
+	showing := selectedConversation != nil &&
+		selectedConversation.ID == response.ConversationID &&
+		currentThreadIndex < len(selectedConversation.Threads) &&
+		selectedConversation.Threads[currentThreadIndex].ID == response.ThreadID
+
+	// A request the cluster turned away is shown but not kept, so it is never sent back to a model
+	if response.Error != "" {
+		node.HandleError(fmt.Errorf("%s", response.Error), node.WARNING, "Request rejected by "+response.NodeID)
+		if showing {
+			appendMessage(chatOutput, "Error", response.Error)
+		}
+		return
+	}
+
 	newMessage := Message{
 		Role:    "Assistant",
 		Content: response.Content,
 	}
 	targetThread.Messages = append(targetThread.Messages, newMessage)
 
-	if selectedConversation != nil && 
-	   selectedConversation.ID == response.ConversationID && 
-	   currentThreadIndex < len(selectedConversation.Threads) &&
-	   selectedConversation.Threads[currentThreadIndex].ID == response.ThreadID {
+	if showing {
 		updateChatOutput(chatOutput, targetThread.Messages)
 	}
 	
@@ -240,16 +330,21 @@ func populateAssistants(msg *nats.Msg, logger *log.Logger) {
 }
 
 func consumeOutChatMessages(js nats.JetStreamContext, logger *log.Logger) error {
-	subject := "out.chat.>"
-	durable := "out_chat_messages"
-	
-	_, err := streams.DurablePull(js, "messages", subject, durable, func(msg *nats.Msg) {
+	subject := responseSubject()
+	durable := "out_chat_" + clientID()
+
+	consumer, err := streams.DurablePull(context.Background(), js, "messages", subject, durable, func(ctx context.Context, msg *nats.Msg) error {
 		populateAssistants(msg, logger)
+		return nil
 	})
 	if err != nil {
+		if legacyResponseConsumerExists(js) {
+			node.HandleError(err, node.ERROR, "Shared response consumer "+legacyResponseConsumer+" from an older version is in the way, run -reconcile as admin once every frontend is upgraded")
+		}
 		node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to set up consumer for subject: %s", subject))
 		return fmt.Errorf("Failed to set up consumer to populate models: %s: %v", subject, err)
 	}
+	metrics.WatchConsumer(durable, consumer.Subscription())
 	
 	node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Successfully set up consumer for subject: %s", subject))
 	logger.Printf("Consumer set up for subject: %s", subject)
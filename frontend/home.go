@@ -0,0 +1,121 @@
+package frontend
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+
+	"github.com/mtmox/AI-cluster/cluster"
+)
+
+var dashboardColumns = []string{"Node", "Status", "Loaded Models", "Active/Max", "Memory", "CPU", "Req/min", "Config", "Last Error"}
+
+var dashboardWidths = []float32{140, 80, 260, 90, 140, 70, 80, 70, 400}
+
+// createHomeTab builds the live cluster dashboard fed by node heartbeats
+func createHomeTab(registry *cluster.NodeRegistry) fyne.CanvasObject {
+	if registry == nil {
+		return widget.NewLabel("Node registry unavailable, cluster dashboard is disabled")
+	}
+
+	summary := widget.NewLabel("Waiting for node heartbeats...")
+
+	var rows []cluster.NodeStatus
+
+	table := widget.NewTableWithHeaders(
+		func() (int, int) { return len(rows), len(dashboardColumns) },
+		func() fyne.CanvasObject { return widget.NewLabel("") },
+		func(id widget.TableCellID, cell fyne.CanvasObject) {
+			if id.Row >= len(rows) {
+				return
+			}
+			cell.(*widget.Label).SetText(dashboardCell(rows[id.Row], id.Col))
+		},
+	)
+	table.ShowHeaderColumn = false
+	table.CreateHeader = func() fyne.CanvasObject { return widget.NewLabel("") }
+	table.UpdateHeader = func(id widget.TableCellID, cell fyne.CanvasObject) {
+		if id.Col >= 0 && id.Col < len(dashboardColumns) {
+			cell.(*widget.Label).SetText(dashboardColumns[id.Col])
+		}
+	}
+	for col, width := range dashboardWidths {
+		table.SetColumnWidth(col, width)
+	}
+
+	refresh := func() {
+		rows = registry.Nodes()
+		online := 0
+		for _, status := range rows {
+			if status.Online {
+				online++
+			}
+		}
+		summary.SetText(fmt.Sprintf("%d of %d nodes online, updated %s, this frontend on config r%d", online, len(rows), time.Now().Format("15:04:05"), configRevision()))
+		table.Refresh()
+	}
+	registry.OnChange(refresh)
+
+	return container.NewBorder(summary, nil, nil, nil, table)
+}
+
+func dashboardCell(status cluster.NodeStatus, col int) string {
+	heartbeat := status.Heartbeat
+	switch col {
+	case 0:
+		if heartbeat.Name != "" {
+			return fmt.Sprintf("%s (%s)", heartbeat.Name, heartbeat.IP)
+		}
+		return heartbeat.NodeID
+	case 1:
+		if !status.Online {
+			return "Offline"
+		}
+		if !heartbeat.OllamaReachable {
+			return "No Ollama"
+		}
+		if heartbeat.Draining {
+			return "Draining"
+		}
+		if !heartbeat.Ready {
+			return "Not Ready"
+		}
+		if heartbeat.Throttle != nil && heartbeat.Throttle.Throttled {
+			return "Throttled"
+		}
+		return "Online"
+	case 2:
+		if len(heartbeat.LoadedModels) == 0 {
+			return "-"
+		}
+		return strings.Join(heartbeat.LoadedModels, ", ")
+	case 3:
+		return fmt.Sprintf("%d/%d", heartbeat.ActiveTasks, heartbeat.MaxParallel)
+	case 4:
+		const gb = 1024 * 1024 * 1024
+		return fmt.Sprintf("%.1f/%.1f GB", float64(heartbeat.MemoryUsed)/gb, float64(heartbeat.MemoryTotal)/gb)
+	case 5:
+		return fmt.Sprintf("%.0f%%", heartbeat.CPUPercent)
+	case 6:
+		return fmt.Sprintf("%d", heartbeat.RequestsPerMinute)
+	case 7:
+		if heartbeat.ConfigRevision == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("r%d", heartbeat.ConfigRevision)
+	case 8:
+		if heartbeat.LastError == "" {
+			if len(heartbeat.NotReady) > 0 {
+				return strings.Join(heartbeat.NotReady, "; ")
+			}
+			return "-"
+		}
+		return fmt.Sprintf("%s %s", heartbeat.LastErrorAt.Format("15:04:05"), heartbeat.LastError)
+	default:
+		return ""
+	}
+}
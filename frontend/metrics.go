@@ -0,0 +1,12 @@
+package frontend
+
+import (
+	"github.com/mtmox/AI-cluster/metrics"
+)
+
+var (
+	requestsSubmitted = metrics.NewCounter("ai_cluster_frontend_requests_submitted_total", "Chat requests published per model", "model")
+	requestsQueued    = metrics.NewCounter("ai_cluster_frontend_requests_throttled_total", "Chat requests held back by the requester rate limit")
+	requestsRejected  = metrics.NewCounter("ai_cluster_frontend_requests_rejected_total", "Chat requests no live node could take")
+	responsesReceived = metrics.NewCounter("ai_cluster_frontend_responses_received_total", "Chat responses received per node", "node")
+)
@@ -0,0 +1,136 @@
+package frontend
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/node"
+	"github.com/mtmox/AI-cluster/protocol"
+	"github.com/mtmox/AI-cluster/ratelimit"
+)
+
+// RequesterLimits is the contents of requester-limits.json. They only hold back this frontend's
+// own submissions, backends enforce the requester limits in the cluster config.
+type RequesterLimits struct {
+	// RequestsPerMinute applies to any requester not listed in Requesters, 0 means unlimited
+	RequestsPerMinute int            `json:"requests_per_minute"`
+	Burst             int            `json:"burst"`
+	Requesters        map[string]int `json:"requesters"`
+}
+
+// queuedMessage is a submission waiting for its requester's bucket
+type queuedMessage struct {
+	js  nats.JetStreamContext
+	msg *protocol.ChatRequest
+}
+
+var (
+	submitQueue  chan queuedMessage
+	submitBucket *ratelimit.Bucket
+	submitOnce   sync.Once
+	submitLock   sync.Mutex
+	// fileLimits is requester-limits.json as read at startup, nil until the queue starts
+	fileLimits *RequesterLimits
+)
+
+// currentRequester names whoever is submitting from this frontend
+func currentRequester() string {
+	if usr, err := user.Current(); err == nil && usr.Username != "" {
+		return usr.Username
+	}
+	return node.GetIdentity().DisplayName()
+}
+
+// loadRequesterLimits reads requester-limits.json, a missing file means no limits
+func loadRequesterLimits() (*RequesterLimits, error) {
+	limits := &RequesterLimits{}
+	data, err := os.ReadFile(constants.RequesterLimitsFile)
+	if os.IsNotExist(err) {
+		return limits, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, limits); err != nil {
+		return nil, fmt.Errorf("failed to parse requester limits: %v", err)
+	}
+	return limits, nil
+}
+
+// startSubmitQueue creates the requester's bucket and the worker that drains queued submissions in order
+func startSubmitQueue() {
+	limits, err := loadRequesterLimits()
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Requester rate limits disabled")
+		limits = &RequesterLimits{}
+	}
+	fileLimits = limits
+	configureSubmitBucket()
+	submitQueue = make(chan queuedMessage, 256)
+
+	go func() {
+		for queued := range submitQueue {
+			currentSubmitBucket().Wait()
+			if err := sendMessageToNATS(queued.js, queued.msg); err != nil {
+				node.HandleError(err, node.ERROR, "Error sending message to NATS")
+				continue
+			}
+			node.HandleError(nil, node.SUCCESS, "Message successfully sent to NATS")
+		}
+	}()
+}
+
+// configureSubmitBucket sizes the requester's bucket from requester-limits.json and the cluster config,
+// keeping the current tokens when the limit has not changed
+func configureSubmitBucket() {
+	submitLock.Lock()
+	defer submitLock.Unlock()
+	if fileLimits == nil {
+		return
+	}
+
+	perMinute, burst := fileLimits.RequestsPerMinute, fileLimits.Burst
+	override, overridden := fileLimits.Requesters[currentRequester()]
+
+	clusterLimits := clusterRateLimits()
+	if clusterLimits.RequesterRequestsPerMinute != nil {
+		perMinute = *clusterLimits.RequesterRequestsPerMinute
+	}
+	if clusterLimits.Burst != nil {
+		burst = *clusterLimits.Burst
+	}
+	if value, ok := clusterLimits.Requesters[currentRequester()]; ok {
+		override, overridden = value, true
+	}
+	if overridden {
+		perMinute = override
+	}
+
+	if !submitBucket.Matches(perMinute, burst) {
+		submitBucket = ratelimit.NewBucket(perMinute, burst)
+	}
+}
+
+// currentSubmitBucket returns the requester's bucket, which a cluster config change may replace
+func currentSubmitBucket() *ratelimit.Bucket {
+	submitLock.Lock()
+	defer submitLock.Unlock()
+	return submitBucket
+}
+
+// queueMessageForNATS submits a message, holding it back while the requester is over their rate limit
+func queueMessageForNATS(js nats.JetStreamContext, msg *protocol.ChatRequest) {
+	submitOnce.Do(startSubmitQueue)
+
+	if bucket := currentSubmitBucket(); !bucket.Ready() {
+		requestsQueued.Inc()
+		node.HandleError(nil, node.WARNING, fmt.Sprintf("Rate limit reached for %s, message queued for %s", currentRequester(), bucket.Delay()))
+	}
+	submitQueue <- queuedMessage{js: js, msg: msg}
+}
@@ -2,6 +2,7 @@
 package frontend
 
 import (
+	"fmt"
 	"log"
 
 	"fyne.io/fyne/v2"
@@ -10,6 +11,10 @@ import (
 	"fyne.io/fyne/v2/widget"
 
 	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/cluster"
+	"github.com/mtmox/AI-cluster/node"
+	"github.com/mtmox/AI-cluster/streams"
 )
 
 // Add this global variable
@@ -20,14 +25,39 @@ var selectedConversation *Conversation
 var threadsList *widget.List
 var chatOutput *widget.Entry
 
+// nodeRegistry is shared by the dashboard, admin view and placement checks
+var nodeRegistry *cluster.NodeRegistry
+
 func StartFrontend(js nats.JetStreamContext, logger *log.Logger) {
 	a := app.New()
 	w := a.NewWindow("AI Interface")
 
+	// Show in the title bar when NATS is away, messages sent meanwhile are held until it returns
+	streams.OnConnectionChange(func(state streams.ConnectionState) {
+		if state == streams.Connected {
+			w.SetTitle("AI Interface")
+			return
+		}
+		w.SetTitle(fmt.Sprintf("AI Interface - NATS %s", state))
+	})
+
+	// The dashboard and admin view share one watch on the heartbeat bucket
+	registry, err := cluster.WatchNodes(js)
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Failed to watch node heartbeats")
+	}
+	nodeRegistry = registry
+
+	// Prompt library, requester limits and stream limits follow the cluster config bucket
+	if err := watchClusterConfig(js); err != nil {
+		node.HandleError(err, node.WARNING, "Running on local settings only")
+	}
+
 	tabs := container.NewAppTabs(
-		container.NewTabItem("Home", widget.NewLabel("Home Tab Content")),
+		container.NewTabItem("Home", createHomeTab(registry)),
 		container.NewTabItem("Chat", createChatTab(js)),
 		container.NewTabItem("Generate", widget.NewLabel("Generate Tab Content")),
+		container.NewTabItem("Admin", createAdminTab(registry)),
 	)
 
 	w.SetContent(tabs)
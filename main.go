@@ -2,26 +2,70 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/nats-io/nats.go"
 	
+	"github.com/mtmox/AI-cluster/config"
 	"github.com/mtmox/AI-cluster/constants"
 	"github.com/mtmox/AI-cluster/streams"
 	"github.com/mtmox/AI-cluster/nats_server"
 	"github.com/mtmox/AI-cluster/frontend"
 	"github.com/mtmox/AI-cluster/backend"
+	"github.com/mtmox/AI-cluster/cluster"
+	"github.com/mtmox/AI-cluster/metrics"
 	"github.com/mtmox/AI-cluster/node"
+	"github.com/mtmox/AI-cluster/scheduler"
 )
 
+// loadConfig applies config.toml and the command line overrides, exiting on an invalid configuration
+func loadConfig(path, natsURL, ollamaURL, rootDir string) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if natsURL != "" {
+		cfg.NATS.URL = natsURL
+	}
+	if ollamaURL != "" {
+		cfg.Ollama.URL = ollamaURL
+	}
+	if rootDir != "" {
+		cfg.Paths.Root = rootDir
+	}
+	if err := cfg.Apply(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+}
+
 func main() {
 	// Define flags
 	isFrontend := flag.Bool("frontend", false, "Run as frontend instance")
 	isBackend := flag.Bool("backend", false, "Run as backend instance")
+	isScheduler := flag.Bool("scheduler", false, "Run as model placement scheduler")
+	isBenchmark := flag.Bool("benchmark", false, "Benchmark every local model and exit")
+	isReconcile := flag.Bool("reconcile", false, "Bring streams and declared consumers in line with streams.go, delete retired consumers and exit")
+	dryRun := flag.Bool("dry-run", false, "With -reconcile, only print the changes")
+	isServer := flag.Bool("server", false, "Run an embedded NATS server with JetStream, configured by [nats_server] in config.toml")
+	benchmarkCluster := flag.Bool("cluster", false, "With -benchmark, dispatch the suite to every live node instead")
+	simulateFile := flag.String("simulate", "", "With -scheduler, run the placement policy against a scenario file offline")
+	upgradeModel := flag.String("upgrade", "", "With -scheduler, re-pull a model tag node by node and exit")
+	pushConfig := flag.String("push-config", "", "With -scheduler, publish a cluster config JSON file to the config bucket and exit")
+	configNode := flag.String("config-node", "", "With -push-config, store the file as this node's override rather than the cluster defaults")
+	httpAddr := flag.String("http", "", "Serve /metrics, and on backends /healthz and /readyz, on this address, e.g. :9100")
+	configFile := flag.String("config", "", "Path to config.toml, defaults to $AI_CLUSTER_CONFIG or ~/AI-cluster/config.toml")
+	natsURL := flag.String("nats-url", "", "NATS server URL, overrides config.toml and the environment")
+	ollamaURL := flag.String("ollama-url", "", "Ollama API URL, overrides config.toml and the environment")
+	rootDir := flag.String("root", "", "Root directory for cluster files, overrides config.toml and the environment")
+	genNatsConf := flag.String("gen-nats-conf", "", "Write nats-server.conf with frontend, backend and admin users, and their NKey seeds, to this directory and exit")
 
 	// Parse flags
 	flag.Parse()
@@ -29,15 +73,63 @@ func main() {
 	// Create a logger
 	logger := log.New(os.Stdout, "", log.LstdFlags)
 
+	// Configuration is layered defaults, config.toml, environment, then flags, and must be settled before anything touches a path
+	loadConfig(*configFile, *natsURL, *ollamaURL, *rootDir)
+
+	// Identify this machine by its persistent node ID rather than its IP
+	identity := node.GetIdentity()
+	if err := node.Initialize(constants.NodeLogFile, identity.ID); err != nil {
+		log.Printf("Failed to initialize node logging: %v", err)
+	}
+	logger.Printf("Node %s (%s) starting", identity.ID, identity.DisplayName())
+
+	// Aliases are optional, without the file models are only known by their tags
+	if err := constants.GetModelRegistry().LoadAliases(constants.ModelAliasesFile); err != nil && !os.IsNotExist(err) {
+		node.HandleError(err, node.WARNING, "Failed to load model aliases from "+constants.ModelAliasesFile)
+	}
+
+	// Generating the server config needs neither NATS nor a mode
+	if *genNatsConf != "" {
+		path, err := nats_server.GenerateServerConfig(*genNatsConf, config.Get().NATSServer)
+		if err != nil {
+			node.HandleError(err, node.FATAL, "Failed to generate nats-server.conf")
+		}
+		node.HandleError(nil, node.SUCCESS, "Wrote "+path+", give each node its role's .nk file, or frontend-<client_id>.nk, as nats.nkey_file")
+		return
+	}
+
 	// Check if exactly one flag is set
-	if (*isFrontend && *isBackend) || (!*isFrontend && !*isBackend) {
-		node.HandleError(fmt.Errorf("invalid flag configuration"), node.FATAL, "Please specify either -frontend or -backend flag")
+	modeCount := 0
+	for _, set := range []bool{*isFrontend, *isBackend, *isScheduler, *isBenchmark, *isServer, *isReconcile} {
+		if set {
+			modeCount++
+		}
+	}
+	if modeCount != 1 {
+		node.HandleError(fmt.Errorf("invalid flag configuration"), node.FATAL, "Please specify exactly one of -frontend, -backend, -scheduler, -benchmark, -server or -reconcile")
+	}
+
+	// The HTTP endpoints are opt-in so several instances can share a machine without port clashes
+	if *httpAddr != "" {
+		metrics.Serve(*httpAddr)
 	}
 
 	// Run the appropriate instance type
 	if *isFrontend {
 		runFrontend(logger)
 		node.HandleError(nil, node.SUCCESS, "Frontend instance completed successfully")
+	} else if *isReconcile {
+		runReconcile(*dryRun)
+		node.HandleError(nil, node.SUCCESS, "Reconciliation completed successfully")
+	} else if *isServer {
+		runServer(logger)
+		node.HandleError(nil, node.SUCCESS, "NATS server instance completed successfully")
+	} else if *isBenchmark {
+		runBenchmark(*benchmarkCluster)
+		node.HandleError(nil, node.SUCCESS, "Benchmark completed successfully")
+	} else if *isScheduler {
+		runScheduler(*simulateFile, *upgradeModel, *pushConfig, *configNode)
+		node.HandleError(nil, node.SUCCESS, "Scheduler instance completed successfully")
 	} else {
 		runBackend(logger)
 		node.HandleError(nil, node.SUCCESS, "Backend instance completed successfully")
@@ -46,7 +138,7 @@ func main() {
 
 func runFrontend(logger *log.Logger) {
 	// Connect to NATS server and get the JetStream context
-	js, err := nats_server.ConnectToNats()
+	js, err := nats_server.ConnectToNats(frontend.ConnectOptions()...)
 	if err != nil {
 		node.HandleError(err, node.FATAL, "Failed to connect to NATS")
 	}
@@ -57,6 +149,49 @@ func runFrontend(logger *log.Logger) {
 	time.Sleep(1 * time.Second)
 }
 
+// runReconcile prints the difference between streams.go and the server, applying it unless dryRun.
+// It is also how consumers retired in streams.go are removed, once no node still uses them.
+func runReconcile(dryRun bool) {
+	js, err := nats_server.ConnectWithoutSetup()
+	if err != nil {
+		node.HandleError(err, node.FATAL, "Failed to connect to NATS")
+	}
+
+	changes, err := nats_server.Reconcile(js, dryRun)
+	if err == nil {
+		var retired []nats_server.Change
+		retired, err = nats_server.RemoveRetired(js, dryRun)
+		changes = append(changes, retired...)
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if len(changes) == 0 {
+		fmt.Println("Streams and consumers match streams.go")
+	}
+	if err != nil {
+		node.HandleError(err, node.FATAL, "Reconciliation stopped")
+	}
+}
+
+// runServer hosts the queue in this process until SIGINT or SIGTERM
+func runServer(logger *log.Logger) {
+	ns, err := nats_server.StartEmbedded(config.Get().NATSServer)
+	if err != nil {
+		node.HandleError(err, node.FATAL, "Failed to start embedded NATS server")
+	}
+	if _, err := nats_server.ConnectToEmbedded(ns); err != nil {
+		nats_server.StopEmbedded(ns)
+		node.HandleError(err, node.FATAL, "Failed to create streams on embedded NATS server")
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	received := <-signals
+	logger.Printf("Received %s, shutting down NATS server", received)
+	nats_server.StopEmbedded(ns)
+}
+
 func runBackend(logger *log.Logger) {
 	// Connect to NATS server and get the JetStream context
 	js, err := nats_server.ConnectToNats()
@@ -77,6 +212,118 @@ func runBackend(logger *log.Logger) {
 	time.Sleep(1 * time.Second)
 }
 
+func runScheduler(simulateFile string, upgradeModel string, pushConfig string, configNode string) {
+	policy := scheduler.NewDemandPolicy()
+
+	// Offline mode replays a scenario through the policy and prints the decisions
+	if simulateFile != "" {
+		scenario, err := scheduler.LoadScenario(simulateFile)
+		if err != nil {
+			node.HandleError(err, node.FATAL, "Failed to load scheduler scenario")
+		}
+		results := scheduler.Simulate(policy, scenario)
+		output, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			node.HandleError(err, node.FATAL, "Failed to marshal simulation results")
+		}
+		fmt.Println(string(output))
+		return
+	}
+
+	js, err := nats_server.ConnectToNats()
+	if err != nil {
+		node.HandleError(err, node.FATAL, "Failed to connect to NATS")
+	}
+	node.HandleError(nil, node.SUCCESS, "Successfully connected to NATS server")
+
+	if pushConfig != "" {
+		pushClusterConfig(js, pushConfig, configNode)
+		return
+	}
+
+	registry, err := cluster.WatchNodes(js)
+	if err != nil {
+		node.HandleError(err, node.FATAL, "Failed to watch node heartbeats")
+	}
+
+	// Rolling upgrades are a one-shot command rather than a long running scheduler
+	if upgradeModel != "" {
+		if err := scheduler.RollingUpgrade(nats_server.GetConnection(), registry, upgradeModel, 30*time.Minute); err != nil {
+			node.HandleError(err, node.FATAL, "Rolling upgrade failed")
+		}
+		node.HandleError(nil, node.SUCCESS, "Rolling upgrade complete for "+upgradeModel)
+		return
+	}
+
+	coordinator := scheduler.NewCoordinator(nats_server.GetConnection(), registry, policy, 10*time.Second)
+	if benchmarks, err := cluster.WatchBenchmarks(js); err != nil {
+		node.HandleError(err, node.WARNING, "Placement will ignore benchmark results")
+	} else {
+		coordinator.SetBenchmarks(benchmarks)
+	}
+	if err := coordinator.Start(); err != nil {
+		node.HandleError(err, node.FATAL, "Failed to start scheduler")
+	}
+
+	select {}
+}
+
+// pushClusterConfig publishes a cluster config file as the defaults, or as one node's override
+func pushClusterConfig(js nats.JetStreamContext, path string, nodeID string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		node.HandleError(err, node.FATAL, "Failed to read cluster config "+path)
+	}
+	var config cluster.ClusterConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		node.HandleError(err, node.FATAL, "Cluster config is not valid JSON")
+	}
+
+	key := cluster.DefaultsConfigKey
+	if nodeID != "" {
+		key = cluster.NodeConfigKey(nodeID)
+	}
+	revision, err := cluster.PutConfig(js, key, config)
+	if err != nil {
+		node.HandleError(err, node.FATAL, "Failed to publish cluster config")
+	}
+	node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Published cluster config %s at revision %d", key, revision))
+}
+
+func runBenchmark(clusterWide bool) {
+	js, err := nats_server.ConnectToNats()
+	if err != nil {
+		// A local run is still useful offline, it just is not published
+		if clusterWide {
+			node.HandleError(err, node.FATAL, "Failed to connect to NATS")
+		}
+		node.HandleError(err, node.WARNING, "Benchmarking offline, results will only be stored locally")
+	}
+
+	var results []constants.BenchmarkResult
+	if clusterWide {
+		registry, err := cluster.WatchNodes(js)
+		if err != nil {
+			node.HandleError(err, node.FATAL, "Failed to watch node heartbeats")
+		}
+		results, err = scheduler.DispatchBenchmarks(nats_server.GetConnection(), registry, 15*time.Minute)
+		if err != nil {
+			node.HandleError(err, node.FATAL, "Cluster benchmark failed")
+		}
+	} else {
+		results, err = backend.RunLocalBenchmarks()
+		if err != nil {
+			node.HandleError(err, node.FATAL, "Benchmark failed")
+		}
+	}
+
+	output, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		node.HandleError(err, node.FATAL, "Failed to marshal benchmark results")
+	}
+	fmt.Println(string(output))
+}
+
 func syncModels(js nats.JetStreamContext, logger *log.Logger) ([]string, error) {
 	// Query and write models
 	err := constants.QueryAndWriteModels()
@@ -95,7 +342,8 @@ func syncModels(js nats.JetStreamContext, logger *log.Logger) ([]string, error)
 	}
 	node.HandleError(nil, node.SUCCESS, "Successfully read models information")
 
-	// Extract model names and publish messages for each model
+	// Extract model names and publish messages for each model, all at once and then wait for the acks
+	publisher := streams.NewPublisher(js, streams.PublisherOptions{})
 	var modelNames []string
 	for _, model := range modelsResp.Models {
 		modelNames = append(modelNames, model.Name)
@@ -104,15 +352,32 @@ func syncModels(js nats.JetStreamContext, logger *log.Logger) ([]string, error)
 			Name: model.Name,
 		}
 
-		// Publish modelNames to NATS
-		subject := "config.sync.models"
-		err = streams.PublishToNats(js, subject, msg)
+		// Capabilities are best effort, a model without them is still usable
+		caps, err := constants.QueryModelCapabilities(model.Name)
+		if err != nil {
+			node.HandleError(err, node.WARNING, fmt.Sprintf("Failed to query capabilities for %s", model.Name))
+		} else {
+			msg.Capabilities = *caps
+			constants.GetModelRegistry().SetCapabilities(model.Name, *caps)
+		}
+
+		data, err := json.Marshal(msg)
 		if err != nil {
+			node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to marshal model message for %s", model.Name))
+			return nil, err
+		}
+
+		// Publish modelNames to NATS
+		subject := "models.sync"
+		if err := publisher.PublishAsync(context.Background(), subject, data, nil); err != nil {
 			node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to publish model message for %s", model.Name))
 			return nil, err
 		}
-		node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Successfully published model sync message for: %s", model.Name))
 	}
 
+	if err := publisher.Flush(context.Background()); err != nil {
+		return nil, err
+	}
+	node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Successfully published model sync messages for %d models", len(modelNames)))
 	return modelNames, nil
 }
\ No newline at end of file
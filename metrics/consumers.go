@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/node"
+)
+
+var (
+	consumerPending    = NewGauge("ai_cluster_consumer_pending", "Messages waiting for a consumer", "consumer")
+	consumerAckPending = NewGauge("ai_cluster_consumer_ack_pending", "Messages delivered to a consumer but not yet acknowledged", "consumer")
+)
+
+// WatchConsumer reports a JetStream subscription's backlog on every scrape
+func WatchConsumer(name string, subscription *nats.Subscription) {
+	OnScrape(func() {
+		info, err := subscription.ConsumerInfo()
+		if err != nil {
+			node.HandleError(err, node.WARNING, "Failed to read consumer info for metrics")
+			return
+		}
+		consumerPending.Set(float64(info.NumPending), name)
+		consumerAckPending.Set(float64(info.NumAckPending), name)
+	})
+}
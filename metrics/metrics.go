@@ -0,0 +1,253 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtmox/AI-cluster/node"
+)
+
+// DefaultBuckets suit LLM requests, which take from under a second to several minutes
+var DefaultBuckets = []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300}
+
+// collector is anything that can write itself in the Prometheus text format
+type collector interface {
+	write(b *strings.Builder)
+}
+
+var (
+	collectors     []collector
+	scrapeHooks    []func()
+	registryMutex  sync.Mutex
+	mux            = http.NewServeMux()
+	muxInitialised sync.Once
+)
+
+func register(c collector) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	collectors = append(collectors, c)
+}
+
+// OnScrape runs a function before every scrape, for gauges that are cheaper to read than to track
+func OnScrape(hook func()) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	scrapeHooks = append(scrapeHooks, hook)
+}
+
+// labelKey joins label values so they can key a map
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels renders {name="value",...} for a joined key
+func formatLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, fmt.Sprintf("%s=%q", names[i], value))
+			}
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a value that only goes up, optionally split by labels
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	mutex  sync.Mutex
+}
+
+// NewCounter creates and registers a counter
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// Inc adds one for the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds a positive amount for the given label values
+func (c *Counter) Add(amount float64, labelValues ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[labelKey(labelValues)] += amount
+}
+
+func (c *Counter) write(b *strings.Builder) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(b, "%s%s %g\n", c.name, formatLabels(c.labels, key), c.values[key])
+	}
+}
+
+// Gauge is a value that can go up and down, optionally split by labels
+type Gauge struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	mutex  sync.Mutex
+}
+
+// NewGauge creates and registers a gauge
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(g)
+	return g
+}
+
+// Set replaces the value for the given label values
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[labelKey(labelValues)] = value
+}
+
+// Reset drops every label set, for gauges rebuilt on each scrape
+func (g *Gauge) Reset() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values = make(map[string]float64)
+}
+
+func (g *Gauge) write(b *strings.Builder) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(b, "%s%s %g\n", g.name, formatLabels(g.labels, key), g.values[key])
+	}
+}
+
+// histogramValues are the observations for one label set
+type histogramValues struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts observations into cumulative buckets, optionally split by labels
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogramValues
+	mutex   sync.Mutex
+}
+
+// NewHistogram creates and registers a histogram with the given upper bounds
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValues)}
+	register(h)
+	return h
+}
+
+// Observe records one value for the given label values
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := labelKey(labelValues)
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValues{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+// ObserveSince records the seconds elapsed since start
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(b *strings.Builder) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", fmt.Sprintf("%g", bound)), v.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), v.count)
+		fmt.Fprintf(b, "%s_sum%s %g\n", h.name, formatLabels(h.labels, key), v.sum)
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, formatLabels(h.labels, key), v.count)
+	}
+}
+
+// Handler serves every registered metric in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryMutex.Lock()
+		hooks := append([]func(){}, scrapeHooks...)
+		registered := append([]collector{}, collectors...)
+		registryMutex.Unlock()
+
+		for _, hook := range hooks {
+			hook()
+		}
+
+		var b strings.Builder
+		for _, c := range registered {
+			c.write(&b)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, b.String())
+	})
+}
+
+// Handle adds another endpoint, such as a health check, to the metrics server
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
+// Serve starts the HTTP server for /metrics and any other registered endpoints
+func Serve(addr string) {
+	muxInitialised.Do(func() {
+		mux.Handle("/metrics", Handler())
+	})
+
+	go func() {
+		node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Serving metrics on %s/metrics", addr))
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			node.HandleError(err, node.ERROR, "Metrics server stopped")
+		}
+	}()
+}
@@ -0,0 +1,246 @@
+package nats_server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+
+	"github.com/mtmox/AI-cluster/config"
+	"github.com/mtmox/AI-cluster/constants"
+)
+
+// authOptions turns the [nats] section into connection options
+func authOptions(cfg config.NATSConfig) ([]nats.Option, error) {
+	var options []nats.Option
+
+	switch {
+	case cfg.CredsFile != "":
+		options = append(options, nats.UserCredentials(cfg.CredsFile))
+	case cfg.NKeyFile != "":
+		option, err := nats.NkeyOptionFromSeed(cfg.NKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load NKey seed %s: %v", cfg.NKeyFile, err)
+		}
+		options = append(options, option)
+	case cfg.User != "":
+		options = append(options, nats.UserInfo(cfg.User, cfg.Password))
+	}
+
+	if cfg.TLS.CAFile != "" {
+		options = append(options, nats.RootCAs(cfg.TLS.CAFile))
+	}
+	if cfg.TLS.CertFile != "" {
+		options = append(options, nats.ClientCert(cfg.TLS.CertFile, cfg.TLS.KeyFile))
+	}
+	if cfg.TLS.Enabled() {
+		options = append(options, nats.Secure())
+	}
+	return options, nil
+}
+
+// Permissions are the subjects a role may publish and subscribe to
+type Permissions struct {
+	Publish   []string
+	Subscribe []string
+}
+
+// consumerAccess lets a client bind to, pull from and acknowledge one durable. It may only create
+// the durable through the filtered create subject, which the server checks against the filter in
+// the request, so a client cannot widen its consumer to read what is meant for others.
+func consumerAccess(stream string, durable string, filter string) []string {
+	return []string{
+		fmt.Sprintf("$JS.API.CONSUMER.INFO.%s.%s", stream, durable),
+		fmt.Sprintf("$JS.API.CONSUMER.CREATE.%s.%s.%s", stream, durable, filter),
+		fmt.Sprintf("$JS.API.CONSUMER.MSG.NEXT.%s.%s", stream, durable),
+		fmt.Sprintf("$JS.ACK.%s.%s.>", stream, durable),
+	}
+}
+
+// kvRead lets a client look up and watch one KV bucket
+func kvRead(bucket string) []string {
+	stream := "KV_" + bucket
+	return []string{
+		"$JS.API.STREAM.INFO." + stream,
+		"$JS.API.STREAM.MSG.GET." + stream,
+		"$JS.API.DIRECT.GET." + stream,
+		"$JS.API.DIRECT.GET." + stream + ".>",
+		"$JS.API.CONSUMER.CREATE." + stream,
+		"$JS.API.CONSUMER.CREATE." + stream + ".>",
+		"$JS.API.CONSUMER.DELETE." + stream + ".>",
+		"$JS.FC." + stream + ".>",
+	}
+}
+
+// kvWrite lets a client put keys into one KV bucket
+func kvWrite(bucket string) []string {
+	return []string{
+		"$JS.API.STREAM.INFO.KV_" + bucket,
+		"$KV." + bucket + ".>",
+	}
+}
+
+// grant joins subject lists into one
+func grant(lists ...[]string) []string {
+	var subjects []string
+	for _, list := range lists {
+		subjects = append(subjects, list...)
+	}
+	return subjects
+}
+
+// FrontendPermissions are what the frontend with this client ID needs: it submits requests as
+// itself and reads its own responses, model announcements and the cluster state. Its inbox is
+// _INBOX.<client> so it cannot see replies meant for anyone else.
+func FrontendPermissions(client string) Permissions {
+	return Permissions{
+		Publish: grant(
+			[]string{
+				"in.chat." + client + ".>",
+				"in.generate." + client + ".>",
+				"$JS.API.INFO",
+				// Only looked up to explain why the per client consumer cannot be created
+				"$JS.API.CONSUMER.INFO.messages.out_chat_messages",
+			},
+			consumerAccess("messages", "out_chat_"+client, "out.chat."+client+".>"),
+			consumerAccess("models", "config_sync_models_"+client, "models.sync"),
+			kvRead(constants.HeartbeatBucket),
+			kvRead(constants.ClusterConfigBucket),
+		),
+		Subscribe: []string{"_INBOX." + client + ".>"},
+	}
+}
+
+// Roles lists the permissions of the shared generated users. Admins, which include the scheduler,
+// may do anything; backends may only take requests from their consumer and answer them. Frontends
+// each get a user of their own, see FrontendPermissions.
+var Roles = map[string]Permissions{
+	"backend": {
+		Publish: grant(
+			[]string{
+				"out.chat.>",
+				"out.generate.>",
+				"models.sync",
+				"_INBOX.>",
+				"$JS.API.INFO",
+			},
+			consumerAccess("messages", "message_processors", "in.chat.>"),
+			kvRead(constants.HeartbeatBucket),
+			kvWrite(constants.HeartbeatBucket),
+			kvRead(constants.ClusterConfigBucket),
+			kvWrite(constants.BenchmarkBucket),
+		),
+		Subscribe: []string{
+			"_INBOX.>",
+			constants.DirectiveSubject + ".>",
+			constants.ControlSubject + ".>",
+		},
+	},
+	"admin": {
+		Publish:   []string{">"},
+		Subscribe: []string{">"},
+	},
+}
+
+// serverUsers names every generated user after its seed file: the shared roles, and frontend-<client>
+// for each of the configured frontend clients
+func serverUsers(server config.NATSServerConfig) map[string]Permissions {
+	users := make(map[string]Permissions, len(Roles)+len(server.FrontendClients))
+	for role, permissions := range Roles {
+		users[role] = permissions
+	}
+	for _, client := range server.FrontendClients {
+		users["frontend-"+client] = FrontendPermissions(client)
+	}
+	return users
+}
+
+// GenerateServerConfig writes nats-server.conf into dir with one NKey user per role and one per
+// frontend client. Each user's seed is written next to it as <user>.nk for clients to use as
+// nats.nkey_file. Existing seeds are kept so regenerating the config does not lock out running nodes.
+func GenerateServerConfig(dir string, server config.NATSServerConfig) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+
+	users := serverUsers(server)
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var entries strings.Builder
+	for _, name := range names {
+		publicKey, err := roleKey(filepath.Join(dir, name+".nk"))
+		if err != nil {
+			return "", err
+		}
+		permissions := users[name]
+		fmt.Fprintf(&entries, "    # %s\n    { nkey: %s, permissions: {\n      publish: %s\n      subscribe: %s\n    } }\n",
+			name, publicKey, subjectList(permissions.Publish), subjectList(permissions.Subscribe))
+	}
+
+	var conf strings.Builder
+	fmt.Fprintf(&conf, "# Generated by AI-cluster -gen-nats-conf, edit config.toml and regenerate instead\n")
+	fmt.Fprintf(&conf, "port: %d\n", server.Port)
+	if server.HTTPPort > 0 {
+		fmt.Fprintf(&conf, "http_port: %d\n", server.HTTPPort)
+	}
+	fmt.Fprintf(&conf, "\nlogtime: true\nlog_file: %q\n", server.LogPath())
+	fmt.Fprintf(&conf, "\njetstream {\n  store_dir: %q\n  max_mem: %s\n  max_file: %s\n}\n", server.StoreDir, server.MaxMem, server.MaxFile)
+
+	if server.TLS.CertFile != "" {
+		fmt.Fprintf(&conf, "\ntls {\n  cert_file: %q\n  key_file: %q\n", server.TLS.CertFile, server.TLS.KeyFile)
+		if server.TLS.CAFile != "" {
+			fmt.Fprintf(&conf, "  ca_file: %q\n", server.TLS.CAFile)
+		}
+		fmt.Fprintf(&conf, "}\n")
+	}
+
+	fmt.Fprintf(&conf, "\nauthorization {\n  users = [\n%s  ]\n}\n", entries.String())
+
+	path := filepath.Join(dir, "nats-server.conf")
+	if err := os.WriteFile(path, []byte(conf.String()), 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return path, nil
+}
+
+// roleKey reads a role's NKey seed, creating it on first use, and returns the public key
+func roleKey(seedFile string) (string, error) {
+	seed, err := os.ReadFile(seedFile)
+	if os.IsNotExist(err) {
+		user, err := nkeys.CreateUser()
+		if err != nil {
+			return "", fmt.Errorf("failed to create NKey: %v", err)
+		}
+		if seed, err = user.Seed(); err != nil {
+			return "", fmt.Errorf("failed to read NKey seed: %v", err)
+		}
+		if err := os.WriteFile(seedFile, seed, 0600); err != nil {
+			return "", fmt.Errorf("failed to write %s: %v", seedFile, err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", seedFile, err)
+	}
+
+	user, err := nkeys.FromSeed([]byte(strings.TrimSpace(string(seed))))
+	if err != nil {
+		return "", fmt.Errorf("invalid NKey seed in %s: %v", seedFile, err)
+	}
+	return user.PublicKey()
+}
+
+// subjectList formats subjects as a nats-server.conf array
+func subjectList(subjects []string) string {
+	quoted := make([]string, len(subjects))
+	for i, subject := range subjects {
+		quoted[i] = fmt.Sprintf("%q", subject)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
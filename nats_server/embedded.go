@@ -0,0 +1,116 @@
+package nats_server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/config"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+// embeddedReadyTimeout is how long the embedded server gets to start accepting clients
+const embeddedReadyTimeout = 10 * time.Second
+
+// StartEmbedded runs a NATS server with JetStream inside this process. A Port of -1 picks a
+// free port, so tests can start one against a temporary store directory.
+func StartEmbedded(cfg config.NATSServerConfig) (*server.Server, error) {
+	options, err := embeddedOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(options.StoreDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create JetStream store %s: %v", options.StoreDir, err)
+	}
+	if options.LogFile != "" {
+		if err := os.MkdirAll(filepath.Dir(options.LogFile), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create NATS log directory: %v", err)
+		}
+	}
+
+	ns, err := server.NewServer(options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create NATS server: %v", err)
+	}
+	ns.ConfigureLogger()
+
+	go ns.Start()
+	if !ns.ReadyForConnections(embeddedReadyTimeout) {
+		ns.Shutdown()
+		return nil, fmt.Errorf("NATS server not ready after %s", embeddedReadyTimeout)
+	}
+
+	node.HandleError(nil, node.SUCCESS, "Embedded NATS server listening on "+ns.ClientURL())
+	return ns, nil
+}
+
+// embeddedOptions builds server options from nats_server.conf_file when set, otherwise from the [nats_server] section
+func embeddedOptions(cfg config.NATSServerConfig) (*server.Options, error) {
+	if cfg.ConfFile != "" {
+		options, err := server.ProcessConfigFile(cfg.ConfFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %v", cfg.ConfFile, err)
+		}
+		options.JetStream = true
+		if options.StoreDir == "" {
+			options.StoreDir = cfg.StoreDir
+		}
+		return options, nil
+	}
+
+	maxMem, err := config.ParseSize(cfg.MaxMem)
+	if err != nil {
+		return nil, err
+	}
+	maxFile, err := config.ParseSize(cfg.MaxFile)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &server.Options{
+		ServerName:         "ai-cluster-" + node.GetNodeID(),
+		Port:               cfg.Port,
+		HTTPPort:           cfg.HTTPPort,
+		JetStream:          true,
+		StoreDir:           cfg.StoreDir,
+		JetStreamMaxMemory: maxMem,
+		JetStreamMaxStore:  maxFile,
+		LogFile:            cfg.LogPath(),
+		Logtime:            true,
+	}
+
+	if cfg.TLS.CertFile != "" {
+		tlsConfig, err := server.GenTLSConfig(&server.TLSConfigOpts{
+			CertFile: cfg.TLS.CertFile,
+			KeyFile:  cfg.TLS.KeyFile,
+			CaFile:   cfg.TLS.CAFile,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load NATS server TLS: %v", err)
+		}
+		options.TLSConfig = tlsConfig
+		options.TLS = true
+	}
+	return options, nil
+}
+
+// ConnectToEmbedded connects to an embedded server in process, creating the streams and
+// buckets, so the server process can also run the scheduler or answer health checks
+func ConnectToEmbedded(ns *server.Server) (nats.JetStreamContext, error) {
+	return connect(ns.ClientURL(), true, nats.InProcessServer(ns))
+}
+
+// StopEmbedded closes this process's connection and shuts the server down, letting JetStream flush to disk
+func StopEmbedded(ns *server.Server) {
+	if natsConn != nil {
+		natsConn.Close()
+	}
+	ns.Shutdown()
+	ns.WaitForShutdown()
+	node.HandleError(nil, node.SUCCESS, "Embedded NATS server stopped")
+}
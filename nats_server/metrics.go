@@ -0,0 +1,22 @@
+package nats_server
+
+import (
+	"github.com/mtmox/AI-cluster/metrics"
+	"github.com/mtmox/AI-cluster/streams"
+)
+
+var (
+	natsConnected   = metrics.NewGauge("ai_cluster_nats_connected", "1 while the NATS connection is up")
+	natsDisconnects = metrics.NewCounter("ai_cluster_nats_disconnects_total", "Times the NATS connection dropped")
+	natsReconnects  = metrics.NewCounter("ai_cluster_nats_reconnects_total", "Times the NATS connection was re-established")
+)
+
+func init() {
+	metrics.OnScrape(func() {
+		connected := 0.0
+		if state, _ := streams.Connection(); state == streams.Connected {
+			connected = 1
+		}
+		natsConnected.Set(connected)
+	})
+}
@@ -0,0 +1,318 @@
+package nats_server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/node"
+	"github.com/mtmox/AI-cluster/streams"
+)
+
+// Reconcile actions
+const (
+	ActionCreate   = "create"
+	ActionUpdate   = "update"
+	ActionRecreate = "recreate"
+	ActionDelete   = "delete"
+)
+
+// Change is one difference between streams.go and the server
+type Change struct {
+	Kind   string        `json:"kind"`
+	Name   string        `json:"name"`
+	Action string        `json:"action"`
+	Fields []FieldChange `json:"fields,omitempty"`
+	// Applied is false for dry runs and for recreations, which are only ever reported
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// FieldChange is a setting whose server value differs from the desired one
+type FieldChange struct {
+	Field   string `json:"field"`
+	Current string `json:"current"`
+	Desired string `json:"desired"`
+}
+
+func (c Change) String() string {
+	var fields []string
+	for _, field := range c.Fields {
+		fields = append(fields, fmt.Sprintf("%s %s -> %s", field.Field, field.Current, field.Desired))
+	}
+	status := "planned"
+	if c.Applied {
+		status = "applied"
+	} else if c.Action == ActionRecreate {
+		status = "needs manual recreation"
+	}
+	if c.Error != "" {
+		status = "failed: " + c.Error
+	}
+	return fmt.Sprintf("%s %s %s [%s] %s", c.Action, c.Kind, c.Name, status, strings.Join(fields, ", "))
+}
+
+// Reconcile brings the server's streams and declared consumers in line with streams.go.
+// Missing ones are created and settings the server can change in place are updated.
+// Settings that need the stream or consumer recreated are reported, never applied,
+// because recreating drops its messages. With dryRun nothing is changed.
+func Reconcile(js nats.JetStreamContext, dryRun bool) ([]Change, error) {
+	var changes []Change
+	for _, desired := range streams.StreamConfigs() {
+		streamChanges, err := reconcileStream(js, desired, dryRun)
+		if err != nil {
+			return changes, err
+		}
+		changes = append(changes, streamChanges...)
+	}
+	for _, desired := range streams.Consumers {
+		consumerChanges, err := reconcileConsumer(js, desired, dryRun)
+		if err != nil {
+			return changes, err
+		}
+		changes = append(changes, consumerChanges...)
+	}
+	return changes, nil
+}
+
+// RemoveRetired deletes the retired consumers in streams.go still on the server. It is kept out
+// of Reconcile, which every node runs when it connects, so it only happens when asked for.
+func RemoveRetired(js nats.JetStreamContext, dryRun bool) ([]Change, error) {
+	var changes []Change
+	for _, retired := range streams.RetiredConsumers {
+		name := retired.Stream + "/" + retired.Config.Durable
+		_, err := js.ConsumerInfo(retired.Stream, retired.Config.Durable)
+		if errors.Is(err, nats.ErrConsumerNotFound) || errors.Is(err, nats.ErrStreamNotFound) {
+			continue
+		}
+		if err != nil {
+			return changes, fmt.Errorf("failed to read consumer %s: %v", name, err)
+		}
+
+		change := Change{Kind: "consumer", Name: name, Action: ActionDelete}
+		if !dryRun {
+			if err := js.DeleteConsumer(retired.Stream, retired.Config.Durable); err != nil {
+				change.Error = err.Error()
+			} else {
+				change.Applied = true
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// streamConfig is the server form of a desired stream
+func streamConfig(desired streams.StreamConfig) *nats.StreamConfig {
+	config := &nats.StreamConfig{
+		Name:       desired.Name,
+		Subjects:   desired.Subjects,
+		Retention:  desired.Retention,
+		Discard:    desired.Discard,
+		Storage:    desired.Storage,
+		MaxAge:     desired.MaxAge,
+		MaxMsgs:    desired.MaxMsgs,
+		MaxBytes:   desired.MaxBytes,
+		Replicas:   desired.Replicas,
+		Duplicates: desired.Duplicates,
+	}
+	if config.MaxMsgs == 0 {
+		config.MaxMsgs = -1
+	}
+	if config.MaxBytes == 0 {
+		config.MaxBytes = -1
+	}
+	if config.Replicas == 0 {
+		config.Replicas = 1
+	}
+	return config
+}
+
+func reconcileStream(js nats.JetStreamContext, desired streams.StreamConfig, dryRun bool) ([]Change, error) {
+	target := streamConfig(desired)
+
+	info, err := js.StreamInfo(desired.Name)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		change := Change{Kind: "stream", Name: desired.Name, Action: ActionCreate}
+		if !dryRun {
+			if _, err := js.AddStream(target); err != nil {
+				change.Error = err.Error()
+			} else {
+				change.Applied = true
+			}
+		}
+		return []Change{change}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stream %s: %v", desired.Name, err)
+	}
+
+	current := info.Config
+	updated := current
+	var safe, unsafe []FieldChange
+	note := func(list *[]FieldChange, field string, currentValue, desiredValue interface{}) {
+		*list = append(*list, FieldChange{Field: field, Current: fmt.Sprint(currentValue), Desired: fmt.Sprint(desiredValue)})
+	}
+
+	if !sameSubjects(current.Subjects, target.Subjects) {
+		note(&safe, "subjects", current.Subjects, target.Subjects)
+		updated.Subjects = target.Subjects
+	}
+	if current.MaxAge != target.MaxAge {
+		note(&safe, "max_age", current.MaxAge, target.MaxAge)
+		updated.MaxAge = target.MaxAge
+	}
+	if current.MaxMsgs != target.MaxMsgs {
+		note(&safe, "max_msgs", current.MaxMsgs, target.MaxMsgs)
+		updated.MaxMsgs = target.MaxMsgs
+	}
+	if current.MaxBytes != target.MaxBytes {
+		note(&safe, "max_bytes", current.MaxBytes, target.MaxBytes)
+		updated.MaxBytes = target.MaxBytes
+	}
+	if current.Discard != target.Discard {
+		note(&safe, "discard", current.Discard, target.Discard)
+		updated.Discard = target.Discard
+	}
+	if current.Replicas != target.Replicas {
+		note(&safe, "replicas", current.Replicas, target.Replicas)
+		updated.Replicas = target.Replicas
+	}
+	// A zero duplicate window keeps whatever the server chose
+	if target.Duplicates != 0 && current.Duplicates != target.Duplicates {
+		note(&safe, "duplicates", current.Duplicates, target.Duplicates)
+		updated.Duplicates = target.Duplicates
+	}
+	if current.Retention != target.Retention {
+		note(&unsafe, "retention", current.Retention, target.Retention)
+	}
+	if current.Storage != target.Storage {
+		note(&unsafe, "storage", current.Storage, target.Storage)
+	}
+
+	var changes []Change
+	if len(safe) > 0 {
+		change := Change{Kind: "stream", Name: desired.Name, Action: ActionUpdate, Fields: safe}
+		if !dryRun {
+			if _, err := js.UpdateStream(&updated); err != nil {
+				change.Error = err.Error()
+			} else {
+				change.Applied = true
+			}
+		}
+		changes = append(changes, change)
+	}
+	if len(unsafe) > 0 {
+		changes = append(changes, Change{Kind: "stream", Name: desired.Name, Action: ActionRecreate, Fields: unsafe})
+	}
+	return changes, nil
+}
+
+func reconcileConsumer(js nats.JetStreamContext, desired streams.ConsumerConfig, dryRun bool) ([]Change, error) {
+	name := desired.Stream + "/" + desired.Config.Durable
+	target := desired.Config
+
+	info, err := js.ConsumerInfo(desired.Stream, target.Durable)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		change := Change{Kind: "consumer", Name: name, Action: ActionCreate}
+		if !dryRun {
+			if _, err := js.AddConsumer(desired.Stream, &target); err != nil {
+				change.Error = err.Error()
+			} else {
+				change.Applied = true
+			}
+		}
+		return []Change{change}, nil
+	}
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		// A dry run does not create the stream, its creation is already in the plan
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read consumer %s: %v", name, err)
+	}
+
+	current := info.Config
+	updated := current
+	var safe, unsafe []FieldChange
+	note := func(list *[]FieldChange, field string, currentValue, desiredValue interface{}) {
+		*list = append(*list, FieldChange{Field: field, Current: fmt.Sprint(currentValue), Desired: fmt.Sprint(desiredValue)})
+	}
+
+	if current.FilterSubject != target.FilterSubject {
+		note(&safe, "filter_subject", current.FilterSubject, target.FilterSubject)
+		updated.FilterSubject = target.FilterSubject
+	}
+	// Zero leaves the server default, which the server reports back as a concrete value
+	if target.AckWait != 0 && current.AckWait != target.AckWait {
+		note(&safe, "ack_wait", current.AckWait, target.AckWait)
+		updated.AckWait = target.AckWait
+	}
+	if target.MaxDeliver != 0 && current.MaxDeliver != target.MaxDeliver {
+		note(&safe, "max_deliver", current.MaxDeliver, target.MaxDeliver)
+		updated.MaxDeliver = target.MaxDeliver
+	}
+	if target.MaxAckPending != 0 && current.MaxAckPending != target.MaxAckPending {
+		note(&safe, "max_ack_pending", current.MaxAckPending, target.MaxAckPending)
+		updated.MaxAckPending = target.MaxAckPending
+	}
+	if current.AckPolicy != target.AckPolicy {
+		note(&unsafe, "ack_policy", current.AckPolicy, target.AckPolicy)
+	}
+	if current.DeliverPolicy != target.DeliverPolicy {
+		note(&unsafe, "deliver_policy", current.DeliverPolicy, target.DeliverPolicy)
+	}
+	if current.DeliverGroup != target.DeliverGroup {
+		note(&unsafe, "deliver_group", current.DeliverGroup, target.DeliverGroup)
+	}
+
+	var changes []Change
+	if len(safe) > 0 {
+		change := Change{Kind: "consumer", Name: name, Action: ActionUpdate, Fields: safe}
+		if !dryRun {
+			if _, err := js.UpdateConsumer(desired.Stream, &updated); err != nil {
+				change.Error = err.Error()
+			} else {
+				change.Applied = true
+			}
+		}
+		changes = append(changes, change)
+	}
+	if len(unsafe) > 0 {
+		changes = append(changes, Change{Kind: "consumer", Name: name, Action: ActionRecreate, Fields: unsafe})
+	}
+	return changes, nil
+}
+
+// sameSubjects compares subject lists ignoring order
+func sameSubjects(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]string{}, a...), append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// logChanges reports a reconciliation, warning about anything that still differs
+func logChanges(changes []Change) {
+	for _, change := range changes {
+		switch {
+		case change.Error != "":
+			node.HandleError(errors.New(change.Error), node.ERROR, "Reconcile failed: "+change.String())
+		case change.Action == ActionRecreate:
+			node.HandleError(fmt.Errorf("needs recreation"), node.WARNING, "Reconcile: "+change.String())
+		default:
+			node.HandleError(nil, node.SUCCESS, "Reconcile: "+change.String())
+		}
+	}
+}
@@ -2,34 +2,128 @@
 package nats_server
 
 import (
+	"fmt"
 	"log"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/mtmox/AI-cluster/config"
 	"github.com/mtmox/AI-cluster/constants"
 	"github.com/mtmox/AI-cluster/streams"
 	"github.com/mtmox/AI-cluster/node"
 )
 
-func ConnectToNats() (nats.JetStreamContext, error) {
+var natsConn *nats.Conn
+
+// GetConnection returns the core NATS connection opened by ConnectToNats
+func GetConnection() *nats.Conn {
+	return natsConn
+}
+
+const (
+	// reconnectBase and reconnectMax bound the jittered exponential backoff between connection attempts
+	reconnectBase = 500 * time.Millisecond
+	reconnectMax  = 30 * time.Second
+	// connectAttempts bounds the initial connect, the backoff puts the last attempt about two minutes in
+	connectAttempts = 10
+	// reconnectBufferSize is how much the client holds for the server while reconnecting
+	reconnectBufferSize = 8 * 1024 * 1024
+)
+
+// reconnectDelay doubles from reconnectBase up to reconnectMax, with jitter so nodes do not retry in step
+func reconnectDelay(attempts int) time.Duration {
+	if attempts > 10 {
+		attempts = 10
+	}
+	delay := reconnectBase << attempts
+	if delay > reconnectMax {
+		delay = reconnectMax
+	}
+	return streams.Jitter(delay)
+}
+
+// ConnectToNats connects to the configured NATS URL, extra options are added to the defaults
+func ConnectToNats(extra ...nats.Option) (nats.JetStreamContext, error) {
+	return connect(constants.NatsURL, true, extra...)
+}
+
+// ConnectWithoutSetup connects without touching streams, consumers or buckets, for dry-run reconciliation
+func ConnectWithoutSetup() (nats.JetStreamContext, error) {
+	return connect(constants.NatsURL, false)
+}
+
+// connect dials url with reconnect handling and credentials, then with setup reconciles the streams and buckets
+func connect(url string, setup bool, extra ...nats.Option) (nats.JetStreamContext, error) {
 	var nc *nats.Conn
 	var js nats.JetStreamContext
 	var err error
 
-	// Connect to NATS with retry
-	for i := 0; i < 5; i++ {
-		nc, err = nats.Connect(constants.NatsURL, nats.Timeout(2*time.Second))
+	// Only admins may create and update streams, everyone else relies on an admin having done it
+	if setup && !config.Get().NATS.IsAdmin() {
+		node.HandleError(nil, node.INFO, "Not an admin, leaving stream and bucket setup to admin nodes")
+		setup = false
+	}
+
+	options := []nats.Option{
+		nats.Name("AI-cluster " + node.GetNodeID()),
+		nats.Timeout(2 * time.Second),
+		nats.MaxReconnects(-1),
+		nats.CustomReconnectDelay(reconnectDelay),
+		nats.ReconnectBufSize(reconnectBufferSize),
+		nats.PingInterval(10 * time.Second),
+		nats.MaxPingsOutstanding(3),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			natsDisconnects.Inc()
+			streams.SetConnectionState(streams.Reconnecting)
+			node.HandleError(err, node.WARNING, "Disconnected from NATS, reconnecting")
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			natsReconnects.Inc()
+			node.HandleError(nil, node.SUCCESS, "Reconnected to NATS at "+conn.ConnectedUrl())
+			// The server may have restarted without its state, so put streams and consumers back before anyone publishes.
+			// The context comes from conn, as a reconnect can arrive before connect has made its own.
+			go func() {
+				if setup {
+					if reconnected, err := conn.JetStream(); err != nil {
+						node.HandleError(err, node.WARNING, "Failed to create JetStream context to restore streams")
+					} else {
+						ensureStreams(reconnected)
+					}
+				}
+				streams.RecoverConsumers()
+				streams.SetConnectionState(streams.Connected)
+			}()
+		}),
+		nats.ClosedHandler(func(_ *nats.Conn) {
+			streams.SetConnectionState(streams.Closed)
+			node.HandleError(nil, node.WARNING, "NATS connection closed")
+		}),
+	}
+
+	auth, err := authOptions(config.Get().NATS)
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Invalid NATS credentials")
+		return nil, err
+	}
+	options = append(options, auth...)
+	options = append(options, extra...)
+
+	// Connect to NATS with jittered backoff
+	for i := 0; i < connectAttempts; i++ {
+		nc, err = nats.Connect(url, options...)
 		if err == nil {
 			break
 		}
-		log.Printf("Failed to connect to NATS (attempt %d): %v", i+1, err)
-		time.Sleep(100 * time.Millisecond)
+		delay := reconnectDelay(i)
+		log.Printf("Failed to connect to NATS (attempt %d), retrying in %s: %v", i+1, delay.Round(time.Millisecond), err)
+		time.Sleep(delay)
 	}
 	if err != nil {
-		node.HandleError(err, node.ERROR, "Failed to connect to NATS after 5 attempts")
+		node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to connect to NATS after %d attempts", connectAttempts))
 		return nil, err
 	}
 
+	natsConn = nc
 	node.HandleError(nil, node.SUCCESS, "Successfully connected to NATS")
 
 	// Create JetStream context
@@ -41,45 +135,84 @@ func ConnectToNats() (nats.JetStreamContext, error) {
 
 	node.HandleError(nil, node.SUCCESS, "JetStream context created successfully")
 
-	// Create streams for each configuration
-	for _, streamConfig := range streams.Streams {
-		err := createStream(js, streamConfig)
+	if setup {
+		ensureStreams(js)
+	}
+	streams.SetConnectionState(streams.Connected)
+	return js, nil
+}
+
+// ensureStreams reconciles every stream and declared consumer and creates missing key-value buckets
+func ensureStreams(js nats.JetStreamContext) {
+	changes, err := Reconcile(js, false)
+	if err != nil {
+		node.HandleError(err, node.WARNING, "Error reconciling streams")
+	}
+	logChanges(changes)
+
+	// Create key-value buckets for each configuration
+	for _, kvConfig := range streams.KeyValueBuckets {
+		err := createKeyValue(js, kvConfig)
 		if err != nil {
-			node.HandleError(err, node.WARNING, "Error creating stream "+streamConfig.Name)
+			node.HandleError(err, node.WARNING, "Error creating key-value bucket "+kvConfig.Bucket)
 		} else {
-			node.HandleError(nil, node.SUCCESS, "Stream "+streamConfig.Name+" created/verified successfully")
+			node.HandleError(nil, node.SUCCESS, "Key-value bucket "+kvConfig.Bucket+" created/verified successfully")
 		}
 	}
+}
+
+func createKeyValue(js nats.JetStreamContext, config streams.KeyValueConfig) error {
+	_, err := js.KeyValue(config.Bucket)
+	if err == nil {
+		node.HandleError(nil, node.INFO, "Key-value bucket "+config.Bucket+" already exists")
+		return nil
+	}
+	if err != nats.ErrBucketNotFound {
+		node.HandleError(err, node.ERROR, "Error getting key-value bucket "+config.Bucket)
+		return err
+	}
 
-	return js, nil
+	log.Printf("Key-value bucket %s not found, creating it", config.Bucket)
+	_, err = js.CreateKeyValue(&nats.KeyValueConfig{
+		Bucket:  config.Bucket,
+		TTL:     config.TTL,
+		History: config.History,
+		Storage: nats.FileStorage,
+	})
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Failed to create key-value bucket "+config.Bucket)
+		return err
+	}
+	return nil
 }
 
-func createStream(js nats.JetStreamContext, config streams.StreamConfig) error {
-	streamInfo, err := js.StreamInfo(config.Name)
+// UpdateStreamLimits changes a stream's retention limits in place when they differ, zero leaves a limit as it is.
+// Nodes that are not admins only record the limits, an admin applies them to the server.
+func UpdateStreamLimits(js nats.JetStreamContext, name string, maxAge time.Duration, maxMsgs int64) error {
+	streams.SetStreamLimits(name, maxAge, maxMsgs)
+	if !config.Get().NATS.IsAdmin() {
+		return nil
+	}
+
+	streamInfo, err := js.StreamInfo(name)
 	if err != nil {
-		if err == nats.ErrStreamNotFound {
-			log.Printf("Stream %s not found, creating it", config.Name)
-			_, err = js.AddStream(&nats.StreamConfig{
-				Name:      config.Name,
-				Subjects:  config.Subjects,
-				Retention: config.Retention,
-				Discard:   config.Discard,
-				Storage:   nats.FileStorage,
-				MaxAge:    config.MaxAge,
-				MaxMsgs:   config.MaxMsgs,
-			})
-			if err != nil {
-				node.HandleError(err, node.ERROR, "Failed to create stream "+config.Name)
-				return err
-			}
-			node.HandleError(nil, node.SUCCESS, "Stream "+config.Name+" created successfully")
-		} else {
-			node.HandleError(err, node.ERROR, "Error getting stream info for "+config.Name)
-			return err
-		}
-	} else {
-		node.HandleError(nil, node.INFO, "Stream "+config.Name+" already exists")
-		log.Printf("Stream %s already exists with config: %+v", config.Name, streamInfo.Config)
+		return err
+	}
+
+	config := streamInfo.Config
+	if (maxAge == 0 || config.MaxAge == maxAge) && (maxMsgs == 0 || config.MaxMsgs == maxMsgs) {
+		return nil
+	}
+	if maxAge != 0 {
+		config.MaxAge = maxAge
+	}
+	if maxMsgs != 0 {
+		config.MaxMsgs = maxMsgs
+	}
+
+	if _, err := js.UpdateStream(&config); err != nil {
+		return err
 	}
+	node.HandleError(nil, node.SUCCESS, "Stream "+name+" limits updated")
 	return nil
 }
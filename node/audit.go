@@ -0,0 +1,68 @@
+package node
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"path/filepath"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// CreateAuditDatabase creates the SQLite database that records control commands
+func CreateAuditDatabase(dbPath string) error {
+	// Ensure the database directory exists
+	dbDir := filepath.Dir(dbPath)
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	createTableSQL := `CREATE TABLE IF NOT EXISTS audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time TEXT NOT NULL,
+		issuer TEXT NOT NULL,
+		command TEXT NOT NULL,
+		args TEXT NOT NULL,
+		accepted INTEGER NOT NULL,
+		result TEXT NOT NULL
+	);`
+
+	_, err = db.Exec(createTableSQL)
+	if err != nil {
+		return err
+	}
+
+	return db.Ping()
+}
+
+// InsertAudit records a control command and what the node did with it
+func InsertAudit(dbPath string, timestamp string, issuer string, command string, args string, accepted bool, result string) error {
+	// Ensure the database exists
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		if err := CreateAuditDatabase(dbPath); err != nil {
+			log.Printf("Failed to create audit database: %v", err)
+			return err
+		}
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		log.Printf("Failed to open audit database: %v", err)
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`INSERT INTO audit (time, issuer, command, args, accepted, result) VALUES (?, ?, ?, ?, ?, ?)`,
+		timestamp, issuer, command, args, accepted, result)
+	if err != nil {
+		log.Printf("Failed to insert audit record: %v", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package node
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"path/filepath"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/mtmox/AI-cluster/constants"
+)
+
+// CreateBenchmarkDatabase creates the SQLite database that records benchmark runs
+func CreateBenchmarkDatabase(dbPath string) error {
+	// Ensure the database directory exists
+	dbDir := filepath.Dir(dbPath)
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	createTableSQL := `CREATE TABLE IF NOT EXISTS benchmarks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time TEXT NOT NULL,
+		node_id TEXT NOT NULL,
+		model TEXT NOT NULL,
+		digest TEXT NOT NULL,
+		prompt_tokens_per_second REAL NOT NULL,
+		generation_tokens_per_second REAL NOT NULL,
+		load_seconds REAL NOT NULL,
+		memory_bytes INTEGER NOT NULL,
+		vram_bytes INTEGER NOT NULL,
+		prompts INTEGER NOT NULL
+	);`
+
+	_, err = db.Exec(createTableSQL)
+	if err != nil {
+		return err
+	}
+
+	return db.Ping()
+}
+
+// InsertBenchmark records the summary of one benchmark run
+func InsertBenchmark(dbPath string, result constants.BenchmarkResult) error {
+	// Ensure the database exists
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		if err := CreateBenchmarkDatabase(dbPath); err != nil {
+			log.Printf("Failed to create benchmark database: %v", err)
+			return err
+		}
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		log.Printf("Failed to open benchmark database: %v", err)
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`INSERT INTO benchmarks (time, node_id, model, digest, prompt_tokens_per_second, generation_tokens_per_second, load_seconds, memory_bytes, vram_bytes, prompts) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		result.RunAt.Format("2006-01-02 15:04:05"), result.NodeID, result.Model, result.Digest,
+		result.PromptTokensPerSecond, result.GenerationTokensPerSecond, result.LoadSeconds,
+		result.MemoryBytes, result.VRAMBytes, result.Prompts)
+	if err != nil {
+		log.Printf("Failed to insert benchmark record: %v", err)
+		return err
+	}
+
+	return nil
+}
@@ -57,10 +57,20 @@ var (
 	// Error ID management
 	currentErrorID int
 	errorIDMutex   sync.Mutex
-	counterFile    = filepath.Join(os.ExpandEnv("$HOME"), "AI-cluster", "node", "error_counter.json")
+	counterFile    = constants.ErrorCounterFile
+
+	// Most recent ERROR or FATAL, surfaced in heartbeats
+	lastError      string
+	lastErrorTime  time.Time
+	lastErrorMutex sync.Mutex
 )
 
 func init() {
+	prepareErrorStore()
+}
+
+// prepareErrorStore creates the error counter and database, again from Initialize once paths are configured
+func prepareErrorStore() {
 	// Ensure the directory exists
 	dir := filepath.Dir(counterFile)
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -150,6 +160,15 @@ func Initialize(logFilePath string, machineID string) error {
 
 	computerID = machineID
 
+	// The configured paths may differ from the defaults init ran with
+	if counterFile != constants.ErrorCounterFile {
+		counterFile = constants.ErrorCounterFile
+		prepareErrorStore()
+	}
+	if err := os.MkdirAll(filepath.Dir(logFilePath), 0755); err != nil {
+		return fmt.Errorf("failed to create log directory: %v", err)
+	}
+
 	file, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
 		return fmt.Errorf("failed to open log file: %v", err)
@@ -164,7 +183,11 @@ func Initialize(logFilePath string, machineID string) error {
 
 // generateSignature creates a unique signature for the error
 func generateSignature(file, function string, line int) string {
-	return fmt.Sprintf("%s:%s:%s:%d", GetIPWithoutDots(), file, function, line)
+	id := computerID
+	if id == "" {
+		id = GetNodeID()
+	}
+	return fmt.Sprintf("%s:%s:%s:%d", id, file, function, line)
 }
 
 // getFunctionName returns the name of the function where the error occurred
@@ -243,8 +266,33 @@ func (e *CustomError) Error() string {
 	return e.Message
 }
 
+// LastError returns the most recent ERROR or FATAL message logged by this process
+func LastError() (string, time.Time) {
+	lastErrorMutex.Lock()
+	defer lastErrorMutex.Unlock()
+	return lastError, lastErrorTime
+}
+
+// LogOutput writes a line of output from a child process to the node logs
+func LogOutput(source string, line string) {
+	logMessage := fmt.Sprintf("[%s][%s] %s", time.Now().Format("2006-01-02 15:04:05"), source, line)
+	if !initialized {
+		log.Printf("%s", logMessage)
+		return
+	}
+	fileLogger.Printf("%s", logMessage)
+	stdLogger.Printf("%s", logMessage)
+}
+
 // Log logs the error to both file and stdout
 func (e *CustomError) Log() {
+	if e.Level == ERROR || e.Level == FATAL {
+		lastErrorMutex.Lock()
+		lastError = e.Error()
+		lastErrorTime = e.Timestamp
+		lastErrorMutex.Unlock()
+	}
+
 	sourceLogger, err := createFileLogger(e.File)
 	if err != nil {
 		log.Printf("Failed to create source logger: %v", err)
@@ -0,0 +1,108 @@
+package node
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mtmox/AI-cluster/constants"
+)
+
+// Identity is this machine's persistent identity in the cluster
+type Identity struct {
+	// ID is generated once and never changes, unlike the IP address
+	ID string `json:"id"`
+	// Name is an optional human-friendly name, defaulting to the hostname
+	Name string `json:"name"`
+	// Labels are free-form key/value pairs describing the node
+	Labels map[string]string `json:"labels"`
+}
+
+var (
+	identity     *Identity
+	identityOnce sync.Once
+)
+
+// GetIdentity returns this node's identity, creating and saving one on first run
+func GetIdentity() *Identity {
+	identityOnce.Do(func() {
+		loaded, err := loadIdentity(constants.NodeIdentityFile)
+		if err != nil {
+			log.Printf("Failed to load node identity, using a temporary one: %v", err)
+			loaded = newIdentity()
+		}
+		identity = loaded
+	})
+	return identity
+}
+
+// GetNodeID returns the persistent ID of this node
+func GetNodeID() string {
+	return GetIdentity().ID
+}
+
+// DisplayName returns the friendly name if one is set, otherwise the ID
+func (i *Identity) DisplayName() string {
+	if i.Name != "" {
+		return i.Name
+	}
+	return i.ID
+}
+
+func loadIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		created := newIdentity()
+		if err := saveIdentity(path, created); err != nil {
+			return nil, err
+		}
+		return created, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity file: %v", err)
+	}
+
+	var loaded Identity
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal identity: %v", err)
+	}
+	if loaded.ID == "" {
+		return nil, fmt.Errorf("identity file %s has no id", path)
+	}
+	if loaded.Labels == nil {
+		loaded.Labels = make(map[string]string)
+	}
+	return &loaded, nil
+}
+
+func saveIdentity(path string, id *Identity) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create identity directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal identity: %v", err)
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func newIdentity() *Identity {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		// Fall back to the old IP based scheme rather than running without an ID
+		return &Identity{ID: "node-" + GetIPWithoutDots(), Labels: make(map[string]string)}
+	}
+
+	hostname, _ := os.Hostname()
+	return &Identity{
+		ID:     "node-" + hex.EncodeToString(buf),
+		Name:   hostname,
+		Labels: make(map[string]string),
+	}
+}
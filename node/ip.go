@@ -8,6 +8,11 @@ import (
 
 // GetIPWithoutDots returns the IP address of the computer in dotted notation without dots
 func GetIPWithoutDots() (string) {
+	return strings.ReplaceAll(GetIP(), ".", "")
+}
+
+// GetIP returns the first non-loopback IPv4 address of the computer in dotted notation
+func GetIP() (string) {
 	// Get the list of network interfaces
 	interfaces, err := net.Interfaces()
 	if err != nil {
@@ -40,12 +45,7 @@ func GetIPWithoutDots() (string) {
 			}
 
 			// Convert IP to dotted notation
-			ipString := ip.String()
-
-			// Remove dots from the IP string
-			ipWithoutDots := strings.ReplaceAll(ipString, ".", "")
-
-			return ipWithoutDots
+			return ip.String()
 		}
 	}
 	return ""
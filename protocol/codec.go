@@ -0,0 +1,333 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Codec turns envelopes into message bodies and back
+type Codec interface {
+	// Name is how config.toml selects the codec
+	Name() string
+	// ContentType is sent in the content-type header so receivers pick the same codec
+	ContentType() string
+	Encode(envelope *Envelope) ([]byte, error)
+	Decode(data []byte) (*Envelope, error)
+}
+
+// Built in codecs
+var (
+	JSON   Codec = jsonCodec{}
+	Binary Codec = binaryCodec{}
+)
+
+var (
+	codecs = map[string]Codec{
+		JSON.ContentType():   JSON,
+		Binary.ContentType(): Binary,
+	}
+	codecsLock sync.RWMutex
+)
+
+// RegisterCodec adds a codec, replacing any with the same content type
+func RegisterCodec(codec Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[codec.ContentType()] = codec
+}
+
+// CodecFor returns the codec for a content type
+func CodecFor(contentType string) (Codec, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	codec, ok := codecs[contentType]
+	return codec, ok
+}
+
+// CodecByName returns the codec config.toml calls name
+func CodecByName(name string) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	var names []string
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec, nil
+		}
+		names = append(names, codec.Name())
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown codec %q, expected one of %v", name, names)
+}
+
+// checkEnvelope rejects an envelope this build cannot read, before its payload is decoded
+func checkEnvelope(envelope *Envelope) error {
+	if envelope.Version == LegacyVersion || !Supported.Contains(envelope.Version) {
+		return &VersionError{Version: envelope.Version, Supported: Supported}
+	}
+	return nil
+}
+
+// jsonCodec writes the envelope as a JSON object with the payload under "payload"
+type jsonCodec struct{}
+
+type jsonEnvelope struct {
+	Type          string          `json:"type"`
+	Version       int             `json:"version"`
+	CorrelationID string          `json:"correlation_id"`
+	CreatedAt     time.Time       `json:"created_at"`
+	SentAt        time.Time       `json:"sent_at"`
+	Sender        Sender          `json:"sender"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+func (jsonCodec) Name() string        { return "json" }
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Encode(envelope *Envelope) ([]byte, error) {
+	payload, err := json.Marshal(envelope.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s payload: %v", envelope.Type, err)
+	}
+	return json.Marshal(jsonEnvelope{
+		Type:          envelope.Type,
+		Version:       envelope.Version,
+		CorrelationID: envelope.CorrelationID,
+		CreatedAt:     envelope.CreatedAt,
+		SentAt:        envelope.SentAt,
+		Sender:        envelope.Sender,
+		Payload:       payload,
+	})
+}
+
+func (jsonCodec) Decode(data []byte) (*Envelope, error) {
+	var wire jsonEnvelope
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return nil, fmt.Errorf("failed to decode envelope: %v", err)
+	}
+	envelope := &Envelope{
+		Type:          wire.Type,
+		Version:       wire.Version,
+		CorrelationID: wire.CorrelationID,
+		CreatedAt:     wire.CreatedAt,
+		SentAt:        wire.SentAt,
+		Sender:        wire.Sender,
+	}
+	if err := checkEnvelope(envelope); err != nil {
+		return envelope, err
+	}
+	payload, err := newPayload(wire.Type)
+	if err != nil {
+		return envelope, err
+	}
+	if err := json.Unmarshal(wire.Payload, payload); err != nil {
+		return envelope, fmt.Errorf("failed to decode %s payload: %v", wire.Type, err)
+	}
+	envelope.Payload = payload
+	return envelope, nil
+}
+
+// binaryMagic starts every binary message, so a JSON body is never mistaken for one
+const binaryMagic = 0xA1
+
+// Payload encodings inside a binary envelope
+const (
+	payloadCompact = 0
+	payloadJSON    = 1
+)
+
+// binaryPayload is a payload with a compact binary form, others travel as JSON
+type binaryPayload interface {
+	appendBinary(w *writer)
+	readBinary(r *reader)
+}
+
+// binaryCodec writes the envelope as varints and length prefixed strings:
+// magic, version, type, correlation ID, created and sent as Unix nanoseconds,
+// sender node and client, payload encoding and the length prefixed payload.
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string        { return "binary" }
+func (binaryCodec) ContentType() string { return "application/x-ai-cluster" }
+
+func (binaryCodec) Encode(envelope *Envelope) ([]byte, error) {
+	w := &writer{buf: []byte{binaryMagic}}
+	w.uint(uint64(envelope.Version))
+	w.string(envelope.Type)
+	w.string(envelope.CorrelationID)
+	w.time(envelope.CreatedAt)
+	w.time(envelope.SentAt)
+	w.string(envelope.Sender.NodeID)
+	w.string(envelope.Sender.ClientID)
+
+	if compact, ok := envelope.Payload.(binaryPayload); ok {
+		payload := &writer{}
+		compact.appendBinary(payload)
+		w.buf = append(w.buf, payloadCompact)
+		w.bytes(payload.buf)
+	} else {
+		payload, err := json.Marshal(envelope.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s payload: %v", envelope.Type, err)
+		}
+		w.buf = append(w.buf, payloadJSON)
+		w.bytes(payload)
+	}
+	return w.buf, nil
+}
+
+func (binaryCodec) Decode(data []byte) (*Envelope, error) {
+	if len(data) == 0 || data[0] != binaryMagic {
+		return nil, errors.New("not a binary envelope")
+	}
+	r := &reader{buf: data[1:]}
+	envelope := &Envelope{Version: int(r.uint())}
+	envelope.Type = r.string()
+	envelope.CorrelationID = r.string()
+	envelope.CreatedAt = r.time()
+	envelope.SentAt = r.time()
+	envelope.Sender.NodeID = r.string()
+	envelope.Sender.ClientID = r.string()
+	encoding := r.byte()
+	data = r.bytes()
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to decode envelope: %v", r.err)
+	}
+
+	if err := checkEnvelope(envelope); err != nil {
+		return envelope, err
+	}
+	payload, err := newPayload(envelope.Type)
+	if err != nil {
+		return envelope, err
+	}
+	compact, isCompact := payload.(binaryPayload)
+	switch {
+	case encoding == payloadCompact && isCompact:
+		payloadReader := &reader{buf: data}
+		compact.readBinary(payloadReader)
+		err = payloadReader.err
+	case encoding == payloadJSON:
+		err = json.Unmarshal(data, payload)
+	default:
+		err = fmt.Errorf("unknown payload encoding %d", encoding)
+	}
+	if err != nil {
+		return envelope, fmt.Errorf("failed to decode %s payload: %v", envelope.Type, err)
+	}
+	envelope.Payload = payload
+	return envelope, nil
+}
+
+// writer appends binary fields
+type writer struct {
+	buf []byte
+}
+
+func (w *writer) uint(v uint64) { w.buf = binary.AppendUvarint(w.buf, v) }
+func (w *writer) int(v int64)   { w.buf = binary.AppendVarint(w.buf, v) }
+
+func (w *writer) bytes(b []byte) {
+	w.uint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *writer) string(s string) {
+	w.uint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// time writes Unix nanoseconds, 0 for the zero time
+func (w *writer) time(t time.Time) {
+	if t.IsZero() {
+		w.int(0)
+		return
+	}
+	w.int(t.UnixNano())
+}
+
+// reader reads binary fields. Running out of data between fields reads zero values, so a
+// payload from an older build simply lacks the newer fields; running out inside one is an error.
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, args...)
+	}
+	r.buf = nil
+}
+
+func (r *reader) uint() uint64 {
+	if len(r.buf) == 0 {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail("invalid varint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *reader) int() int64 {
+	if len(r.buf) == 0 {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail("invalid varint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *reader) byte() byte {
+	if len(r.buf) == 0 {
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *reader) bytes() []byte {
+	length := r.uint()
+	if length > uint64(len(r.buf)) {
+		r.fail("field of %d bytes with %d left", length, len(r.buf))
+		return nil
+	}
+	b := r.buf[:length]
+	r.buf = r.buf[length:]
+	return b
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+// count reads a list length, which cannot be more than the bytes left
+func (r *reader) count() int {
+	count := r.uint()
+	if count > uint64(len(r.buf)) {
+		r.fail("list of %d entries with %d bytes left", count, len(r.buf))
+		return 0
+	}
+	return int(count)
+}
+
+func (r *reader) time() time.Time {
+	nanos := r.int()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos).UTC()
+}
@@ -0,0 +1,197 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// update rewrites the golden vectors from this build. Use it only for an intended format change,
+// together with a version bump if older nodes cannot read the result.
+var update = flag.Bool("update", false, "rewrite the golden vectors in testdata")
+
+// vector is one golden message in testdata. Bodies this build writes must match it byte for
+// byte, and every one must still decode, so a change that breaks older nodes fails the tests.
+type vector struct {
+	file     string
+	codec    Codec
+	envelope *Envelope
+	// header is what arrives with a legacy body, which has no envelope of its own
+	header nats.Header
+	// decodeOnly vectors were written by older builds, this build reads them but never writes them
+	decodeOnly bool
+}
+
+var (
+	vectorCreated = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	vectorSent    = vectorCreated.Add(1500 * time.Millisecond)
+)
+
+func vectorRequest() *Envelope {
+	return &Envelope{
+		Type:          TypeChatRequest,
+		Version:       1,
+		CorrelationID: "laptop-alice.conv1.1.2",
+		CreatedAt:     vectorCreated,
+		SentAt:        vectorSent,
+		Sender:        Sender{NodeID: "node-frontend", ClientID: "laptop-alice"},
+		Payload: &ChatRequest{
+			ConversationID: "conv1",
+			ThreadID:       1,
+			ClientID:       "laptop-alice",
+			Model:          "llama3.1:8b",
+			Prefer:         "gpu=nvidia",
+			SystemPrompt:   "You are helpful.",
+			Messages: []ChatMessage{
+				{Role: "user", Content: "Hello"},
+				{Role: "assistant", Content: "Hi, how can I help?"},
+			},
+		},
+	}
+}
+
+func vectorResponse() *Envelope {
+	return &Envelope{
+		Type:          TypeChatResponse,
+		Version:       1,
+		CorrelationID: "laptop-alice.conv1.1.2",
+		CreatedAt:     vectorCreated,
+		SentAt:        vectorSent,
+		Sender:        Sender{NodeID: "node-backend"},
+		Payload: &ChatResponse{
+			ConversationID: "conv1",
+			ThreadID:       1,
+			ClientID:       "laptop-alice",
+			Content:        "Ünïcode and \"quotes\" survive.",
+			NodeID:         "node-backend",
+		},
+	}
+}
+
+func goldenVectors() []vector {
+	legacyRequest := vectorRequest()
+	legacyRequest.Version = LegacyVersion
+	legacyRequest.CreatedAt, legacyRequest.SentAt = time.Time{}, time.Time{}
+	legacyRequest.CorrelationID = ""
+	legacyRequest.Payload.(*ChatRequest).ClientID = ""
+	legacyRequest.Sender.ClientID = ""
+
+	legacyResponse := vectorResponse()
+	legacyResponse.Version = LegacyVersion
+	legacyResponse.CreatedAt, legacyResponse.SentAt = time.Time{}, time.Time{}
+	legacyResponse.CorrelationID = ""
+	legacyResponse.Payload.(*ChatResponse).ClientID = ""
+	legacyResponse.Sender.NodeID = "node-backend"
+
+	rejected := vectorResponse()
+	rejected.Payload.(*ChatResponse).Content = ""
+	rejected.Payload.(*ChatResponse).Error = "unreadable require header: gpu"
+
+	// Binary responses as written before Error was added, which newer builds read with it empty
+	beforeError := nats.Header{}
+	beforeError.Set(HeaderContentType, Binary.ContentType())
+	beforeError.Set(HeaderVersion, "1")
+
+	return []vector{
+		{file: "chat-request.v1.json", codec: JSON, envelope: vectorRequest()},
+		{file: "chat-request.v1.bin", codec: Binary, envelope: vectorRequest()},
+		{file: "chat-response.v1.json", codec: JSON, envelope: vectorResponse()},
+		{file: "chat-response.v1.bin", codec: Binary, envelope: vectorResponse()},
+		{file: "chat-rejected.v1.json", codec: JSON, envelope: rejected},
+		{file: "chat-rejected.v1.bin", codec: Binary, envelope: rejected},
+		{file: "chat-response.v1-before-error.bin", envelope: vectorResponse(), header: beforeError, decodeOnly: true},
+		// What frontends and backends sent before the envelope, message roles were capitalised then
+		{file: "chat-request.v0.json", envelope: legacyRequest, header: nats.Header{"node-id": {"node-frontend"}}, decodeOnly: true},
+		{file: "chat-response.v0.json", envelope: legacyResponse, header: nats.Header{"node-id": {"node-backend"}}, decodeOnly: true},
+	}
+}
+
+func readVector(t *testing.T, file string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGoldenVectors(t *testing.T) {
+	for _, v := range goldenVectors() {
+		t.Run(v.file, func(t *testing.T) {
+			header := v.header
+			if !v.decodeOnly {
+				data, marshalled, err := Marshal(v.envelope, v.codec)
+				if err != nil {
+					t.Fatalf("encode: %v", err)
+				}
+				if *update {
+					if err := os.WriteFile(filepath.Join("testdata", v.file), data, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if golden := readVector(t, v.file); !bytes.Equal(data, golden) {
+					t.Errorf("encoding changed:\n got  %q\n want %q", data, golden)
+				}
+				header = marshalled
+			}
+
+			decoded, err := Unmarshal(readVector(t, v.file), header, v.envelope.Type)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, v.envelope) {
+				t.Errorf("decoded %+v (payload %+v), want %+v (payload %+v)", decoded, decoded.Payload, v.envelope, v.envelope.Payload)
+			}
+		})
+	}
+}
+
+// TestUnknownVersion makes sure a message from a newer build is turned away with a VersionError
+func TestUnknownVersion(t *testing.T) {
+	for _, codec := range []Codec{JSON, Binary} {
+		data, header, err := Marshal(vectorRequest(), codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header.Set(HeaderVersion, strconv.Itoa(Supported.Max+1))
+		decoded, err := Unmarshal(data, header, TypeChatRequest)
+		var versionErr *VersionError
+		if !errors.As(err, &versionErr) {
+			t.Errorf("%s: unknown version gave %v, want a VersionError", codec.Name(), err)
+		}
+		if decoded == nil || decoded.Type != TypeChatRequest {
+			t.Errorf("%s: unknown version lost the message type", codec.Name())
+		}
+	}
+}
+
+// TestAddedFields makes sure fields a newer build adds within a version are skipped
+func TestAddedFields(t *testing.T) {
+	json := bytes.Replace(readVector(t, "chat-request.v1.json"), []byte(`"payload":{`), []byte(`"priority":3,"payload":{"temperature":0.2,`), 1)
+	binary := append(readVector(t, "chat-request.v1.bin"), 0x03, 'n', 'e', 'w')
+
+	for _, added := range []struct {
+		codec Codec
+		data  []byte
+	}{{JSON, json}, {Binary, binary}} {
+		header := nats.Header{}
+		header.Set(HeaderContentType, added.codec.ContentType())
+		header.Set(HeaderVersion, strconv.Itoa(CurrentVersion))
+		decoded, err := Unmarshal(added.data, header, TypeChatRequest)
+		if err != nil {
+			t.Errorf("%s with added fields: %v", added.codec.Name(), err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, vectorRequest()) {
+			t.Errorf("%s with added fields decoded differently", added.codec.Name())
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Versions of the wire format. A version only changes for a breaking change, fields can be
+// added within a version because every codec skips fields it does not know.
+const (
+	// LegacyVersion is a bare payload with no envelope, as sent before versioning
+	LegacyVersion = 0
+	// CurrentVersion is the newest version this build reads and writes
+	CurrentVersion = 1
+)
+
+// Supported are the versions this build reads and writes
+var Supported = VersionRange{Min: LegacyVersion, Max: CurrentVersion}
+
+// Message types
+const (
+	TypeChatRequest  = "chat.request"
+	TypeChatResponse = "chat.response"
+)
+
+// Envelope wraps every message with what a receiver needs before it reads the payload
+type Envelope struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+	// CorrelationID is shared by a request and its response
+	CorrelationID string `json:"correlation_id"`
+	// CreatedAt is when the content was created, SentAt when this copy was sent
+	CreatedAt time.Time `json:"created_at"`
+	SentAt    time.Time `json:"sent_at"`
+	Sender    Sender    `json:"sender"`
+	Payload   Payload   `json:"-"`
+}
+
+// Sender is the node, and for frontends the client, a message came from
+type Sender struct {
+	NodeID   string `json:"node_id"`
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// Payload is the body of a message of a registered type
+type Payload interface {
+	MessageType() string
+}
+
+// VersionRange is the oldest and newest version a node reads and writes. Nodes from before
+// versioning advertise nothing, which is the zero range holding only LegacyVersion.
+type VersionRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// Contains reports whether version is in the range
+func (r VersionRange) Contains(version int) bool {
+	return version >= r.Min && version <= r.Max
+}
+
+func (r VersionRange) String() string {
+	return fmt.Sprintf("v%d-v%d", r.Min, r.Max)
+}
+
+// Negotiate picks the newest version local and every peer can read
+func Negotiate(local VersionRange, peers ...VersionRange) (int, error) {
+	common := local
+	for _, peer := range peers {
+		if peer.Min > common.Min {
+			common.Min = peer.Min
+		}
+		if peer.Max < common.Max {
+			common.Max = peer.Max
+		}
+	}
+	if common.Min > common.Max {
+		return 0, fmt.Errorf("no protocol version shared by %s and every peer", local)
+	}
+	return common.Max, nil
+}
+
+// VersionError is returned for a message in a version this build cannot read. The envelope
+// returned with it still has the type, version and whatever header fields were available.
+type VersionError struct {
+	Version   int
+	Supported VersionRange
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("protocol version %d is not supported, this node reads %s", e.Version, e.Supported)
+}
+
+// UnknownTypeError is returned for a message type with no registered payload
+type UnknownTypeError struct {
+	Type string
+}
+
+func (e *UnknownTypeError) Error() string {
+	return fmt.Sprintf("unknown message type %q", e.Type)
+}
+
+var (
+	payloadTypes = map[string]func() Payload{
+		TypeChatRequest:  func() Payload { return &ChatRequest{} },
+		TypeChatResponse: func() Payload { return &ChatResponse{} },
+	}
+	payloadTypesLock sync.RWMutex
+)
+
+// RegisterType makes a payload type decodable, newPayload returns a pointer to decode into
+func RegisterType(messageType string, newPayload func() Payload) {
+	payloadTypesLock.Lock()
+	defer payloadTypesLock.Unlock()
+	payloadTypes[messageType] = newPayload
+}
+
+// Types lists the registered message types
+func Types() []string {
+	payloadTypesLock.RLock()
+	defer payloadTypesLock.RUnlock()
+	types := make([]string, 0, len(payloadTypes))
+	for messageType := range payloadTypes {
+		types = append(types, messageType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// newPayload returns an empty payload of a registered type
+func newPayload(messageType string) (Payload, error) {
+	payloadTypesLock.RLock()
+	create, ok := payloadTypes[messageType]
+	payloadTypesLock.RUnlock()
+	if !ok {
+		return nil, &UnknownTypeError{Type: messageType}
+	}
+	return create(), nil
+}
@@ -0,0 +1,96 @@
+package protocol
+
+// ChatMessage is one turn of a conversation, in the form Ollama's chat API takes
+type ChatMessage struct {
+	// Role is who wrote the turn, Ollama reads "user", "assistant" and "system"
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// ChatRequest asks a backend to continue a conversation thread
+type ChatRequest struct {
+	ConversationID string `json:"conversation_id"`
+	ThreadID       int    `json:"thread_id"`
+	// ClientID is the frontend the response goes back to
+	ClientID     string        `json:"client_id"`
+	Model        string        `json:"model"`
+	Digest       string        `json:"digest,omitempty"`
+	Require      string        `json:"require,omitempty"`
+	Prefer       string        `json:"prefer,omitempty"`
+	SystemPrompt string        `json:"system_prompt"`
+	Messages     []ChatMessage `json:"messages"`
+}
+
+// MessageType implements Payload
+func (*ChatRequest) MessageType() string { return TypeChatRequest }
+
+// ChatResponse is a backend's answer to a ChatRequest
+type ChatResponse struct {
+	ConversationID string `json:"conversation_id"`
+	ThreadID       int    `json:"thread_id"`
+	// ClientID is the frontend that asked, empty for requests from older frontends
+	ClientID string `json:"client_id,omitempty"`
+	Content  string `json:"content"`
+	NodeID   string `json:"node_id"`
+	// Error is why the request was turned away without an answer, Content is empty then
+	Error string `json:"error,omitempty"`
+}
+
+// MessageType implements Payload
+func (*ChatResponse) MessageType() string { return TypeChatResponse }
+
+// The compact forms write fields in declaration order. New fields go at the end, so older
+// readers stop before them and newer readers find them missing and leave them zero.
+
+func (m *ChatRequest) appendBinary(w *writer) {
+	w.string(m.ConversationID)
+	w.int(int64(m.ThreadID))
+	w.string(m.ClientID)
+	w.string(m.Model)
+	w.string(m.Digest)
+	w.string(m.Require)
+	w.string(m.Prefer)
+	w.string(m.SystemPrompt)
+	w.uint(uint64(len(m.Messages)))
+	for _, message := range m.Messages {
+		w.string(message.Role)
+		w.string(message.Content)
+	}
+}
+
+func (m *ChatRequest) readBinary(r *reader) {
+	m.ConversationID = r.string()
+	m.ThreadID = int(r.int())
+	m.ClientID = r.string()
+	m.Model = r.string()
+	m.Digest = r.string()
+	m.Require = r.string()
+	m.Prefer = r.string()
+	m.SystemPrompt = r.string()
+	count := r.count()
+	if count > 0 {
+		m.Messages = make([]ChatMessage, count)
+	}
+	for i := range m.Messages {
+		m.Messages[i].Role = r.string()
+		m.Messages[i].Content = r.string()
+	}
+}
+
+func (m *ChatResponse) appendBinary(w *writer) {
+	w.string(m.ConversationID)
+	w.int(int64(m.ThreadID))
+	w.string(m.ClientID)
+	w.string(m.Content)
+	w.string(m.NodeID)
+	w.string(m.Error)
+}
+
+func (m *ChatResponse) readBinary(r *reader) {
+	m.ConversationID = r.string()
+	m.ThreadID = int(r.int())
+	m.ClientID = r.string()
+	m.Content = r.string()
+	m.NodeID = r.string()
+	m.Error = r.string()
+}
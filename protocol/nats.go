@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Headers describing the body, so a receiver can check the version before decoding it
+const (
+	HeaderContentType = "content-type"
+	HeaderVersion     = "protocol-version"
+	HeaderType        = "message-type"
+)
+
+// NewEnvelope wraps payload for sending at version
+func NewEnvelope(payload Payload, version int, correlationID string, sender Sender) *Envelope {
+	return &Envelope{
+		Type:          payload.MessageType(),
+		Version:       version,
+		CorrelationID: correlationID,
+		CreatedAt:     time.Now().UTC(),
+		Sender:        sender,
+		Payload:       payload,
+	}
+}
+
+// Reply wraps payload as the answer to request, in the version and with the correlation ID the request used
+func Reply(request *Envelope, payload Payload, sender Sender) *Envelope {
+	return NewEnvelope(payload, request.Version, request.CorrelationID, sender)
+}
+
+// Marshal encodes envelope with codec and returns the headers that describe the body, stamping
+// SentAt if it is not set. At LegacyVersion only the payload is sent, as JSON, which is what
+// nodes from before versioning read.
+func Marshal(envelope *Envelope, codec Codec) ([]byte, nats.Header, error) {
+	if envelope.Payload == nil {
+		return nil, nil, fmt.Errorf("envelope %s has no payload", envelope.Type)
+	}
+	envelope.Type = envelope.Payload.MessageType()
+	if envelope.SentAt.IsZero() {
+		envelope.SentAt = time.Now()
+	}
+	envelope.CreatedAt = envelope.CreatedAt.UTC()
+	envelope.SentAt = envelope.SentAt.UTC()
+
+	header := nats.Header{}
+	header.Set(HeaderType, envelope.Type)
+	if envelope.Version == LegacyVersion {
+		data, err := json.Marshal(envelope.Payload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode %s payload: %v", envelope.Type, err)
+		}
+		return data, header, nil
+	}
+	if !Supported.Contains(envelope.Version) {
+		return nil, nil, &VersionError{Version: envelope.Version, Supported: Supported}
+	}
+
+	data, err := codec.Encode(envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	header.Set(HeaderContentType, codec.ContentType())
+	header.Set(HeaderVersion, strconv.Itoa(envelope.Version))
+	return data, header, nil
+}
+
+// Unmarshal decodes a message body of the expected type. A body without a version header is
+// a legacy payload, wrapped in an envelope built from the other headers. For a version or type
+// this build cannot read it returns a *VersionError or *UnknownTypeError together with an
+// envelope holding what is known, so the caller can log it and leave it for a newer node.
+func Unmarshal(data []byte, header nats.Header, expected string) (*Envelope, error) {
+	versionHeader := header.Get(HeaderVersion)
+	if versionHeader == "" {
+		return unmarshalLegacy(data, header, expected)
+	}
+
+	version, err := strconv.Atoi(versionHeader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header %q", HeaderVersion, versionHeader)
+	}
+	envelope := &Envelope{Type: header.Get(HeaderType), Version: version}
+	// The header is enough to turn away an unknown version, whose body may not even parse
+	if err := checkEnvelope(envelope); err != nil {
+		return envelope, err
+	}
+
+	codec, ok := CodecFor(header.Get(HeaderContentType))
+	if !ok {
+		return envelope, fmt.Errorf("unknown content type %q", header.Get(HeaderContentType))
+	}
+	decoded, err := codec.Decode(data)
+	if decoded == nil {
+		return envelope, err
+	}
+	if err != nil {
+		return decoded, err
+	}
+	if expected != "" && decoded.Type != expected {
+		return decoded, fmt.Errorf("expected a %s message, got %s", expected, decoded.Type)
+	}
+	return decoded, nil
+}
+
+// unmarshalLegacy reads a payload sent before versioning
+func unmarshalLegacy(data []byte, header nats.Header, expected string) (*Envelope, error) {
+	envelope := &Envelope{
+		Type:          expected,
+		Version:       LegacyVersion,
+		CorrelationID: header.Get(nats.MsgIdHdr),
+		Sender: Sender{
+			NodeID:   header.Get("node-id"),
+			ClientID: header.Get("client-id"),
+		},
+	}
+	payload, err := newPayload(expected)
+	if err != nil {
+		return envelope, err
+	}
+	if err := json.Unmarshal(data, payload); err != nil {
+		return envelope, fmt.Errorf("failed to decode legacy %s payload: %v", expected, err)
+	}
+	envelope.Payload = payload
+	return envelope, nil
+}
@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled at a steady rate up to its burst size.
+// A nil Bucket never limits, which is how an unconfigured limit is represented.
+type Bucket struct {
+	perMinute int
+	burst     int
+	tokens    float64
+	last      time.Time
+	throttled int
+	mutex     sync.Mutex
+}
+
+// State is a snapshot of a bucket for telemetry
+type State struct {
+	PerMinute int     `json:"per_minute"`
+	Burst     int     `json:"burst"`
+	Tokens    float64 `json:"tokens"`
+	Throttled int     `json:"throttled"`
+}
+
+// NewBucket creates a full bucket, or returns nil when perMinute is not positive
+func NewBucket(perMinute int, burst int) *Bucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{perMinute: perMinute, burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// Matches reports whether the bucket already has this configuration, so reloads keep its tokens
+func (b *Bucket) Matches(perMinute int, burst int) bool {
+	if b == nil {
+		return perMinute <= 0
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return b.perMinute == perMinute && b.burst == burst
+}
+
+// refill adds the tokens earned since the last call, the caller holds the mutex
+func (b *Bucket) refill() {
+	now := time.Now()
+	rate := float64(b.perMinute) / 60
+	b.tokens = math.Min(float64(b.burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+// Ready reports whether a token is available without taking it
+func (b *Bucket) Ready() bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill()
+	return b.tokens >= 1
+}
+
+// Allow takes a token if one is available and counts a throttle if not
+func (b *Bucket) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		b.throttled++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Refund returns a token taken by Allow when the request could not go ahead after all
+func (b *Bucket) Refund() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens = math.Min(float64(b.burst), b.tokens+1)
+}
+
+// Delay returns how long until the next token is available
+func (b *Bucket) Delay() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill()
+	if b.tokens >= 1 {
+		return 0
+	}
+	rate := float64(b.perMinute) / 60
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// Wait blocks until a token can be taken
+func (b *Bucket) Wait() {
+	for !b.Allow() {
+		time.Sleep(b.Delay())
+	}
+}
+
+// State returns the bucket's configuration, current tokens and throttle count
+func (b *Bucket) State() State {
+	if b == nil {
+		return State{}
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill()
+	return State{PerMinute: b.perMinute, Burst: b.burst, Tokens: b.tokens, Throttled: b.throttled}
+}
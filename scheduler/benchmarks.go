@@ -0,0 +1,88 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/cluster"
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+// DispatchBenchmarks asks every live node to benchmark each of its models.
+// Nodes run in parallel but each works through its models one at a time so runs do not skew each other.
+func DispatchBenchmarks(nc *nats.Conn, registry *cluster.NodeRegistry, perModelTimeout time.Duration) ([]constants.BenchmarkResult, error) {
+	if !registry.WaitReady(10 * time.Second) {
+		return nil, fmt.Errorf("timed out reading node heartbeats")
+	}
+
+	online := registry.Online()
+	if len(online) == 0 {
+		return nil, fmt.Errorf("no live nodes to benchmark")
+	}
+
+	var results []constants.BenchmarkResult
+	var resultsLock sync.Mutex
+	var wg sync.WaitGroup
+
+	for id, heartbeat := range online {
+		wg.Add(1)
+		go func(id string, models []string) {
+			defer wg.Done()
+			for _, model := range models {
+				result, err := requestBenchmark(nc, id, model, perModelTimeout)
+				if err != nil {
+					node.HandleError(err, node.ERROR, fmt.Sprintf("Benchmark of %s on node %s failed", model, id))
+					continue
+				}
+				resultsLock.Lock()
+				results = append(results, *result)
+				resultsLock.Unlock()
+			}
+		}(id, heartbeat.AvailableModels)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Model != results[j].Model {
+			return results[i].Model < results[j].Model
+		}
+		return results[i].GenerationTokensPerSecond > results[j].GenerationTokensPerSecond
+	})
+	return results, nil
+}
+
+func requestBenchmark(nc *nats.Conn, nodeID, model string, timeout time.Duration) (*constants.BenchmarkResult, error) {
+	directive := constants.PlacementDirective{
+		NodeID: nodeID,
+		Action: constants.DirectiveBenchmark,
+		Model:  model,
+		Reason: "cluster benchmark",
+	}
+	data, err := json.Marshal(directive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal benchmark directive: %v", err)
+	}
+
+	reply, err := nc.Request(fmt.Sprintf("%s.%s", constants.DirectiveSubject, nodeID), data, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("no result: %v", err)
+	}
+
+	var result constants.DirectiveResult
+	if err := json.Unmarshal(reply.Data, &result); err != nil {
+		return nil, fmt.Errorf("invalid reply: %v", err)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("%s", result.Error)
+	}
+	if result.Benchmark == nil {
+		return nil, fmt.Errorf("node replied without a benchmark, it may be running an older version")
+	}
+	return result.Benchmark, nil
+}
@@ -0,0 +1,229 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/cluster"
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+const (
+	// requestTTL drops requests that never received a response so they stop counting as demand
+	requestTTL = 15 * time.Minute
+	// directiveCooldown stops the same directive being resent while a node is still acting on it
+	directiveCooldown = time.Minute
+)
+
+type pendingRequest struct {
+	model    string
+	queuedAt time.Time
+}
+
+// Coordinator watches demand and node load and sends placement directives to backends
+type Coordinator struct {
+	nc       *nats.Conn
+	registry *cluster.NodeRegistry
+	policy   Policy
+	interval time.Duration
+	// benchmarks is optional, placement falls back to memory alone without it
+	benchmarks *cluster.BenchmarkBoard
+
+	mutex       sync.Mutex
+	pending     map[string]pendingRequest // keyed by conversation.thread
+	lastRequest map[string]time.Time
+	// warmSince is when each model was first seen loaded on any node, it starts the idle clock
+	warmSince map[string]time.Time
+	issued    map[string]time.Time
+	lastDrift string
+}
+
+// NewCoordinator creates a Coordinator that runs the given policy every interval
+func NewCoordinator(nc *nats.Conn, registry *cluster.NodeRegistry, policy Policy, interval time.Duration) *Coordinator {
+	return &Coordinator{
+		nc:          nc,
+		registry:    registry,
+		policy:      policy,
+		interval:    interval,
+		pending:     make(map[string]pendingRequest),
+		lastRequest: make(map[string]time.Time),
+		warmSince:   make(map[string]time.Time),
+		issued:      make(map[string]time.Time),
+	}
+}
+
+// SetBenchmarks lets placement favour the nodes that ran a model fastest
+func (c *Coordinator) SetBenchmarks(board *cluster.BenchmarkBoard) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.benchmarks = board
+}
+
+// Start subscribes to cluster traffic and begins the decision loop
+func (c *Coordinator) Start() error {
+	subscriptions := map[string]nats.MsgHandler{
+		"in.chat.>":  c.handleRequest,
+		"out.chat.>": c.handleResponse,
+	}
+	for subject, handler := range subscriptions {
+		if _, err := c.nc.Subscribe(subject, handler); err != nil {
+			node.HandleError(err, node.ERROR, fmt.Sprintf("Scheduler failed to subscribe to %s", subject))
+			return fmt.Errorf("failed to subscribe to %s: %v", subject, err)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.runOnce()
+		}
+	}()
+
+	node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Scheduler started with %s policy", c.policy.Name()))
+	return nil
+}
+
+func (c *Coordinator) handleRequest(msg *nats.Msg) {
+	model := msg.Header.Get("model")
+	if model == "" {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pending[requestKey(msg.Subject)] = pendingRequest{model: model, queuedAt: time.Now()}
+	c.lastRequest[model] = time.Now()
+}
+
+func (c *Coordinator) handleResponse(msg *nats.Msg) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.pending, requestKey(msg.Subject))
+}
+
+// Snapshot builds the ClusterState the policy decides on
+func (c *Coordinator) Snapshot() ClusterState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	state := ClusterState{
+		Now:    now,
+		Nodes:  make(map[string]constants.NodeLoadReport),
+		Models: make(map[string]ModelDemand),
+	}
+
+	// Only nodes with a live heartbeat can take placements
+	for id, heartbeat := range c.registry.Online() {
+		state.Nodes[id] = heartbeat.NodeLoadReport
+	}
+	if c.benchmarks != nil {
+		state.Benchmarks = c.benchmarks.All()
+	}
+
+	// A model that goes cold and is loaded again later starts a new idle clock
+	loaded := make(map[string]bool)
+	for _, report := range state.Nodes {
+		for _, model := range report.LoadedModels {
+			loaded[model] = true
+			if _, ok := c.warmSince[model]; !ok {
+				c.warmSince[model] = now
+			}
+		}
+	}
+	for model := range c.warmSince {
+		if !loaded[model] {
+			delete(c.warmSince, model)
+		}
+	}
+
+	for key, request := range c.pending {
+		if now.Sub(request.queuedAt) > requestTTL {
+			delete(c.pending, key)
+			continue
+		}
+		demand := state.Models[request.model]
+		demand.Pending++
+		state.Models[request.model] = demand
+	}
+
+	for model, last := range c.lastRequest {
+		demand := state.Models[model]
+		demand.LastRequest = last
+		state.Models[model] = demand
+	}
+	for model, since := range c.warmSince {
+		demand := state.Models[model]
+		if since.After(demand.LastRequest) {
+			demand.LastRequest = since
+		}
+		state.Models[model] = demand
+	}
+
+	return state
+}
+
+func (c *Coordinator) runOnce() {
+	state := c.Snapshot()
+	c.checkDrift(state.Nodes)
+
+	directives := c.policy.Decide(state)
+	now := time.Now()
+	for _, directive := range directives {
+		key := directive.NodeID + "|" + directive.Action + "|" + directive.Model
+		if issuedAt, ok := c.issued[key]; ok && now.Sub(issuedAt) < directiveCooldown {
+			continue
+		}
+
+		data, err := json.Marshal(directive)
+		if err != nil {
+			node.HandleError(err, node.ERROR, "Failed to marshal placement directive")
+			continue
+		}
+
+		subject := fmt.Sprintf("%s.%s", constants.DirectiveSubject, directive.NodeID)
+		if err := c.nc.Publish(subject, data); err != nil {
+			node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to send directive to node %s", directive.NodeID))
+			continue
+		}
+		c.issued[key] = now
+		node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Directive sent: %s %s on %s (%s)", directive.Action, directive.Model, directive.NodeID, directive.Reason))
+	}
+}
+
+// checkDrift announces tag/digest mismatches whenever the set of mismatches changes
+func (c *Coordinator) checkDrift(nodes map[string]constants.NodeLoadReport) {
+	drift := DetectDigestDrift(nodes)
+	data, err := json.Marshal(drift)
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Failed to marshal digest drift")
+		return
+	}
+	if string(data) == c.lastDrift {
+		return
+	}
+	c.lastDrift = string(data)
+
+	for _, d := range drift {
+		node.HandleError(fmt.Errorf("digests: %v", d.Digests), node.WARNING, fmt.Sprintf("Model %s has different weights on different nodes", d.Model))
+	}
+	if err := c.nc.Publish(constants.DriftSubject, data); err != nil {
+		node.HandleError(err, node.WARNING, "Failed to publish digest drift")
+	}
+}
+
+// requestKey strips the in/out prefix so a request and its response share a key
+func requestKey(subject string) string {
+	parts := strings.SplitN(subject, ".", 3)
+	if len(parts) < 3 {
+		return subject
+	}
+	return parts[2]
+}
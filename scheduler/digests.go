@@ -0,0 +1,106 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/cluster"
+	"github.com/mtmox/AI-cluster/constants"
+	"github.com/mtmox/AI-cluster/node"
+)
+
+// DigestDrift is a tag that resolves to different weights on different nodes
+type DigestDrift struct {
+	Model   string              `json:"model"`
+	Digests map[string][]string `json:"digests"` // digest -> node IDs
+}
+
+// DetectDigestDrift compares every tag's digest across the cluster inventory
+func DetectDigestDrift(nodes map[string]constants.NodeLoadReport) []DigestDrift {
+	byModel := make(map[string]map[string][]string)
+	for id, report := range nodes {
+		for model, digest := range report.ModelDigests {
+			if byModel[model] == nil {
+				byModel[model] = make(map[string][]string)
+			}
+			byModel[model][digest] = append(byModel[model][digest], id)
+		}
+	}
+
+	var drift []DigestDrift
+	for model, digests := range byModel {
+		if len(digests) < 2 {
+			continue
+		}
+		for digest := range digests {
+			sort.Strings(digests[digest])
+		}
+		drift = append(drift, DigestDrift{Model: model, Digests: digests})
+	}
+	sort.Slice(drift, func(i, j int) bool {
+		return drift[i].Model < drift[j].Model
+	})
+	return drift
+}
+
+// RollingUpgrade re-pulls a tag one node at a time so the rest of the cluster keeps serving it
+func RollingUpgrade(nc *nats.Conn, registry *cluster.NodeRegistry, model string, pullTimeout time.Duration) error {
+	if !registry.WaitReady(10 * time.Second) {
+		return fmt.Errorf("timed out reading node heartbeats")
+	}
+
+	var holders []string
+	for id, report := range registry.Online() {
+		if _, ok := report.ModelDigests[model]; ok {
+			holders = append(holders, id)
+		}
+	}
+	sort.Strings(holders)
+
+	if len(holders) == 0 {
+		return fmt.Errorf("no live node has %s", model)
+	}
+	if len(holders) < 2 {
+		return fmt.Errorf("only node %s has %s, upgrading it would leave nobody serving the model", holders[0], model)
+	}
+
+	digests := make(map[string]constants.NodeLoadReport)
+	for _, id := range holders {
+		directive := constants.PlacementDirective{
+			NodeID: id,
+			Action: constants.DirectivePull,
+			Model:  model,
+			Reason: "rolling upgrade",
+		}
+		data, err := json.Marshal(directive)
+		if err != nil {
+			return fmt.Errorf("failed to marshal pull directive: %v", err)
+		}
+
+		node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Upgrading %s on node %s (%d other nodes still serving)", model, id, len(holders)-1))
+		reply, err := nc.Request(fmt.Sprintf("%s.%s", constants.DirectiveSubject, id), data, pullTimeout)
+		if err != nil {
+			return fmt.Errorf("upgrade of %s on node %s did not complete: %v", model, id, err)
+		}
+
+		var result constants.DirectiveResult
+		if err := json.Unmarshal(reply.Data, &result); err != nil {
+			return fmt.Errorf("invalid reply from node %s: %v", id, err)
+		}
+		if result.Error != "" {
+			return fmt.Errorf("upgrade of %s on node %s failed: %s", model, id, result.Error)
+		}
+
+		node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Node %s now serves %s at digest %s", id, model, result.Digest))
+		digests[id] = constants.NodeLoadReport{NodeID: id, ModelDigests: map[string]string{model: result.Digest}}
+	}
+
+	if drift := DetectDigestDrift(digests); len(drift) > 0 {
+		return fmt.Errorf("nodes still disagree on %s after upgrade: %v", model, drift[0].Digests)
+	}
+	return nil
+}
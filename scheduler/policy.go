@@ -0,0 +1,209 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mtmox/AI-cluster/constants"
+)
+
+// ModelDemand is the outstanding work for a single model
+type ModelDemand struct {
+	Pending int `json:"pending"`
+	// LastRequest is when the model was last asked for, or first seen loaded if that is later
+	LastRequest time.Time `json:"last_request"`
+}
+
+// ClusterState is everything a policy sees when making placement decisions
+type ClusterState struct {
+	Now    time.Time                           `json:"now"`
+	Nodes  map[string]constants.NodeLoadReport `json:"nodes"`
+	Models map[string]ModelDemand              `json:"models"`
+	// Benchmarks holds the latest benchmark per node ID and then model, if any were run
+	Benchmarks map[string]map[string]constants.BenchmarkResult `json:"benchmarks,omitempty"`
+}
+
+// Policy decides which nodes should keep which models warm
+type Policy interface {
+	Name() string
+	Decide(state ClusterState) []constants.PlacementDirective
+}
+
+// DemandPolicy adds replicas for busy models and releases models nobody is asking for
+type DemandPolicy struct {
+	// PendingPerReplica is how many queued requests one warm replica is expected to absorb
+	PendingPerReplica int
+	// IdleTimeout is how long a model must go without requests before it is unloaded
+	IdleTimeout time.Duration
+	// MinFreeMemory is the free RAM in bytes a node must have before it is asked to load
+	MinFreeMemory uint64
+}
+
+// NewDemandPolicy returns a DemandPolicy with sensible defaults
+func NewDemandPolicy() *DemandPolicy {
+	return &DemandPolicy{
+		PendingPerReplica: 2,
+		IdleTimeout:       10 * time.Minute,
+		MinFreeMemory:     4 * 1024 * 1024 * 1024,
+	}
+}
+
+func (p *DemandPolicy) Name() string {
+	return "demand"
+}
+
+func (p *DemandPolicy) Decide(state ClusterState) []constants.PlacementDirective {
+	var directives []constants.PlacementDirective
+
+	// Track planned changes so one decision round does not overcommit a node
+	loadedCount := make(map[string]int)
+	for id, report := range state.Nodes {
+		loadedCount[id] = len(report.LoadedModels)
+	}
+
+	// Loaded models with no recorded demand are still candidates for release once idle
+	demands := make(map[string]ModelDemand)
+	for model, demand := range state.Models {
+		demands[model] = demand
+	}
+	for _, report := range state.Nodes {
+		for _, model := range report.LoadedModels {
+			if _, ok := demands[model]; !ok {
+				demands[model] = ModelDemand{}
+			}
+		}
+	}
+
+	models := make([]string, 0, len(demands))
+	for model := range demands {
+		models = append(models, model)
+	}
+	// Busiest models get first pick of free nodes
+	sort.Slice(models, func(i, j int) bool {
+		a, b := demands[models[i]], demands[models[j]]
+		if a.Pending != b.Pending {
+			return a.Pending > b.Pending
+		}
+		return models[i] < models[j]
+	})
+
+	for _, model := range models {
+		demand := demands[model]
+		warm := nodesWithModel(state, model, true)
+		desired := p.desiredReplicas(state, model, demand)
+
+		if desired > len(warm) {
+			candidates := p.loadCandidates(state, model, loadedCount)
+			for _, id := range candidates {
+				if desired <= len(warm) {
+					break
+				}
+				directives = append(directives, constants.PlacementDirective{
+					NodeID: id,
+					Action: constants.DirectiveLoad,
+					Model:  model,
+					Reason: fmt.Sprintf("%d pending requests across %d warm replicas", demand.Pending, len(warm)),
+				})
+				warm = append(warm, id)
+				loadedCount[id]++
+			}
+		} else if desired < len(warm) {
+			// Release replicas on the least busy nodes first
+			sort.Slice(warm, func(i, j int) bool {
+				return state.Nodes[warm[i]].ActiveTasks < state.Nodes[warm[j]].ActiveTasks
+			})
+			for _, id := range warm[:len(warm)-desired] {
+				directives = append(directives, constants.PlacementDirective{
+					NodeID: id,
+					Action: constants.DirectiveUnload,
+					Model:  model,
+					Reason: fmt.Sprintf("%d pending requests need only %d replicas", demand.Pending, desired),
+				})
+				loadedCount[id]--
+			}
+		}
+	}
+
+	return directives
+}
+
+func (p *DemandPolicy) desiredReplicas(state ClusterState, model string, demand ModelDemand) int {
+	if demand.Pending == 0 {
+		// A model with no request on record counts as just seen rather than idle since forever,
+		// callers start its idle clock when they first see it loaded
+		if !demand.LastRequest.IsZero() && state.Now.Sub(demand.LastRequest) >= p.IdleTimeout {
+			return 0
+		}
+		// Keep whatever is warm until the model has been idle long enough
+		return len(nodesWithModel(state, model, true))
+	}
+
+	perReplica := p.PendingPerReplica
+	if perReplica < 1 {
+		perReplica = 1
+	}
+	desired := (demand.Pending + perReplica - 1) / perReplica
+
+	if capacity := len(nodesWithModel(state, model, false)); desired > capacity {
+		desired = capacity
+	}
+	return desired
+}
+
+// loadCandidates returns nodes that have the model on disk but not in memory, best first
+func (p *DemandPolicy) loadCandidates(state ClusterState, model string, loadedCount map[string]int) []string {
+	var candidates []string
+	for id, report := range state.Nodes {
+		if !contains(report.AvailableModels, model) || contains(report.LoadedModels, model) {
+			continue
+		}
+		if report.MaxLoadedModels > 0 && loadedCount[id] >= report.MaxLoadedModels {
+			continue
+		}
+		if report.MemoryTotal-report.MemoryUsed < p.MinFreeMemory {
+			continue
+		}
+		candidates = append(candidates, id)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := state.Nodes[candidates[i]], state.Nodes[candidates[j]]
+		if loadedCount[candidates[i]] != loadedCount[candidates[j]] {
+			return loadedCount[candidates[i]] < loadedCount[candidates[j]]
+		}
+		// Benchmarked nodes that generate this model faster win, unbenchmarked ones count as zero
+		speedA := state.Benchmarks[candidates[i]][model].GenerationTokensPerSecond
+		speedB := state.Benchmarks[candidates[j]][model].GenerationTokensPerSecond
+		if speedA != speedB {
+			return speedA > speedB
+		}
+		return a.MemoryTotal-a.MemoryUsed > b.MemoryTotal-b.MemoryUsed
+	})
+	return candidates
+}
+
+// nodesWithModel lists nodes that have the model loaded, or merely available when loaded is false
+func nodesWithModel(state ClusterState, model string, loaded bool) []string {
+	var ids []string
+	for id, report := range state.Nodes {
+		list := report.AvailableModels
+		if loaded {
+			list = report.LoadedModels
+		}
+		if contains(list, model) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
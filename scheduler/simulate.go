@@ -0,0 +1,121 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mtmox/AI-cluster/constants"
+)
+
+// Scenario describes a cluster and a demand timeline for offline policy runs
+type Scenario struct {
+	Nodes []constants.NodeLoadReport `json:"nodes"`
+	Steps []ScenarioStep             `json:"steps"`
+}
+
+// ScenarioStep is the queue depth per model at a point in the simulated timeline
+type ScenarioStep struct {
+	AfterSeconds int            `json:"after_seconds"`
+	Pending      map[string]int `json:"pending"`
+}
+
+// SimulationStep records what the policy decided at one step and the placement that resulted
+type SimulationStep struct {
+	AfterSeconds int                            `json:"after_seconds"`
+	Directives   []constants.PlacementDirective `json:"directives"`
+	Placement    map[string][]string            `json:"placement"`
+}
+
+// LoadScenario reads a Scenario from a JSON file
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading scenario: %v", err)
+	}
+
+	var scenario Scenario
+	if err := json.Unmarshal(data, &scenario); err != nil {
+		return nil, fmt.Errorf("error parsing scenario: %v", err)
+	}
+	return &scenario, nil
+}
+
+// Simulate runs a policy against a scenario without touching NATS or Ollama.
+// Directives are assumed to take effect before the next step.
+func Simulate(policy Policy, scenario *Scenario) []SimulationStep {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Models warm at the start have their idle clock start with the scenario, as the scheduler's would
+	nodes := make(map[string]constants.NodeLoadReport)
+	lastRequest := make(map[string]time.Time)
+	for _, report := range scenario.Nodes {
+		report.LoadedModels = append([]string(nil), report.LoadedModels...)
+		nodes[report.NodeID] = report
+		for _, model := range report.LoadedModels {
+			lastRequest[model] = start
+		}
+	}
+
+	var results []SimulationStep
+	for _, step := range scenario.Steps {
+		now := start.Add(time.Duration(step.AfterSeconds) * time.Second)
+
+		state := ClusterState{
+			Now:    now,
+			Nodes:  make(map[string]constants.NodeLoadReport),
+			Models: make(map[string]ModelDemand),
+		}
+		for id, report := range nodes {
+			state.Nodes[id] = report
+		}
+		for model, pending := range step.Pending {
+			if pending > 0 {
+				lastRequest[model] = now
+			}
+		}
+		for model, last := range lastRequest {
+			state.Models[model] = ModelDemand{Pending: step.Pending[model], LastRequest: last}
+		}
+
+		directives := policy.Decide(state)
+		for _, directive := range directives {
+			report, ok := nodes[directive.NodeID]
+			if !ok {
+				continue
+			}
+			switch directive.Action {
+			case constants.DirectiveLoad:
+				if !contains(report.LoadedModels, directive.Model) {
+					report.LoadedModels = append(report.LoadedModels, directive.Model)
+				}
+			case constants.DirectiveUnload:
+				report.LoadedModels = remove(report.LoadedModels, directive.Model)
+			}
+			nodes[directive.NodeID] = report
+		}
+
+		placement := make(map[string][]string)
+		for id, report := range nodes {
+			placement[id] = append([]string(nil), report.LoadedModels...)
+		}
+		results = append(results, SimulationStep{
+			AfterSeconds: step.AfterSeconds,
+			Directives:   directives,
+			Placement:    placement,
+		})
+	}
+
+	return results
+}
+
+func remove(list []string, value string) []string {
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != value {
+			result = append(result, item)
+		}
+	}
+	return result
+}
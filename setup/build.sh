@@ -61,8 +61,12 @@ if [ ! -f "go.mod" ]; then
     exit 1
 fi
 
+# Stamp the binary with the checked out revision so heartbeats report it
+BUILD_VERSION=$(git describe --always --dirty 2>/dev/null || echo "dev")
+echo "Build version: $BUILD_VERSION"
+
 # Run go build
-if ! go build .; then
+if ! go build -ldflags "-X github.com/mtmox/AI-cluster/constants.BuildVersion=$BUILD_VERSION" .; then
     echo "Error: Failed to run go build"
     echo "Contents of directory:"
     ls -la
@@ -81,7 +81,10 @@ echo "$(date '+%Y-%m-%d %H:%M:%S') - Starting GO binary as $INSTANCE_TYPE instan
 cd "$ai_cluster_dir"
 echo "$(date '+%Y-%m-%d %H:%M:%S') - Changed directory to: $ai_cluster_dir"
 
+# Backends serve /metrics, /healthz and /readyz so tooling can tell whether they work
+HTTP_ADDR="${HTTP_ADDR:-:9100}"
+
 # Execute the binary and log its output
-"$GO_BINARY" "-$INSTANCE_TYPE" 2>&1 | while read -r line; do
+"$GO_BINARY" "-$INSTANCE_TYPE" -http "$HTTP_ADDR" 2>&1 | while read -r line; do
     echo "$(date '+%Y-%m-%d %H:%M:%S') - $line"
 done
\ No newline at end of file
@@ -20,8 +20,19 @@ logging.basicConfig(
 )
 
 # Configuration
-SERVER_IP = '192.168.1.16'  # Replace with your server's hostname
-SERVER_URL = f'http://{SERVER_IP}:8090'
+def load_control_server(default='192.168.1.16:8090'):
+    # [setup] control_server in config.toml, shared with the Go binary
+    path = os.environ.get('AI_CLUSTER_CONFIG', os.path.join(os.environ['HOME'], 'AI-cluster', 'config.toml'))
+    try:
+        import tomllib
+        with open(path, 'rb') as f:
+            return tomllib.load(f).get('setup', {}).get('control_server', default)
+    except (ImportError, OSError, ValueError):
+        return default
+
+CONTROL_SERVER = load_control_server()
+SERVER_IP = CONTROL_SERVER.rsplit(':', 1)[0]
+SERVER_URL = f'http://{CONTROL_SERVER}'
 RUN_STOP = os.path.join(os.environ['HOME'], 'AI-cluster', 'setup', 'stop.sh')
 
 def is_server():
@@ -0,0 +1,192 @@
+package streams
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/node"
+)
+
+// ConnectionState is the NATS connection as the rest of the process sees it
+type ConnectionState string
+
+const (
+	Connecting   ConnectionState = "connecting"
+	Connected    ConnectionState = "connected"
+	Reconnecting ConnectionState = "reconnecting"
+	Closed       ConnectionState = "closed"
+)
+
+// PublishBufferWindow is how long a publish waits for NATS to come back before giving up
+const PublishBufferWindow = 30 * time.Second
+
+var (
+	connState     = Connecting
+	connSince     = time.Now()
+	connListeners []func(ConnectionState)
+	connChanged   = make(chan struct{})
+	connLock      sync.Mutex
+)
+
+// SetConnectionState records a connection change and tells every listener, called from the NATS callbacks
+func SetConnectionState(state ConnectionState) {
+	connLock.Lock()
+	if state == connState {
+		connLock.Unlock()
+		return
+	}
+	connState = state
+	connSince = time.Now()
+	close(connChanged)
+	connChanged = make(chan struct{})
+	listeners := append([]func(ConnectionState){}, connListeners...)
+	connLock.Unlock()
+
+	for _, listener := range listeners {
+		listener(state)
+	}
+}
+
+// Connection returns the current connection state and when it began
+func Connection() (ConnectionState, time.Time) {
+	connLock.Lock()
+	defer connLock.Unlock()
+	return connState, connSince
+}
+
+// OnConnectionChange registers a callback for every connection state change
+func OnConnectionChange(listener func(ConnectionState)) {
+	connLock.Lock()
+	defer connLock.Unlock()
+	connListeners = append(connListeners, listener)
+}
+
+// WaitConnected blocks until NATS is connected or the timeout passes, a timeout of 0 waits indefinitely
+func WaitConnected(timeout time.Duration) bool {
+	return waitConnected(context.Background(), timeout)
+}
+
+// waitConnected is WaitConnected that also gives up when ctx ends
+func waitConnected(ctx context.Context, timeout time.Duration) bool {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		connLock.Lock()
+		state, changed := connState, connChanged
+		connLock.Unlock()
+
+		if state == Connected {
+			return true
+		}
+		if state == Closed {
+			return false
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Jitter spreads a delay by up to half again so many clients do not retry in step
+func Jitter(delay time.Duration) time.Duration {
+	if delay <= 0 {
+		return 0
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// recoverableConsumer is what is needed to put a durable consumer back after the server loses it
+type recoverableConsumer struct {
+	js     nats.JetStreamContext
+	stream string
+	config nats.ConsumerConfig
+}
+
+var (
+	consumers     = make(map[string]recoverableConsumer)
+	consumersLock sync.Mutex
+)
+
+// trackConsumer remembers a durable consumer so it can be re-created after a server restart
+func trackConsumer(js nats.JetStreamContext, stream string, config *nats.ConsumerConfig) {
+	consumersLock.Lock()
+	defer consumersLock.Unlock()
+	consumers[config.Durable] = recoverableConsumer{js: js, stream: stream, config: *config}
+}
+
+// ensure re-creates a tracked consumer if the server no longer has it
+func (c recoverableConsumer) ensure() error {
+	_, err := c.js.ConsumerInfo(c.stream, c.config.Durable)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrConsumerNotFound) {
+		return err
+	}
+
+	config := c.config
+	if _, err := c.js.AddConsumer(c.stream, &config); err != nil && !errors.Is(err, nats.ErrConsumerNameAlreadyInUse) {
+		return fmt.Errorf("failed to re-create consumer %s: %v", c.config.Durable, err)
+	}
+	node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Re-created consumer %s on stream %s", c.config.Durable, c.stream))
+	return nil
+}
+
+// RecoverConsumer is called after a failed fetch. It waits out a disconnect, then makes sure
+// the durable consumer still exists, pausing briefly so a failing fetch loop does not spin.
+// It gives up with ctx.Err() as soon as ctx ends, so stopping a consumer never waits on NATS.
+func RecoverConsumer(ctx context.Context, durable string) error {
+	if state, _ := Connection(); state != Connected {
+		waitConnected(ctx, 0)
+		return ctx.Err()
+	}
+
+	consumersLock.Lock()
+	consumer, ok := consumers[durable]
+	consumersLock.Unlock()
+	if ok {
+		if err := consumer.ensure(); err != nil {
+			node.HandleError(err, node.WARNING, "Failed to verify consumer "+durable)
+		}
+	}
+
+	timer := time.NewTimer(Jitter(500 * time.Millisecond))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RecoverConsumers verifies every tracked consumer, run once streams are back after a reconnect
+func RecoverConsumers() {
+	consumersLock.Lock()
+	tracked := make([]recoverableConsumer, 0, len(consumers))
+	for _, consumer := range consumers {
+		tracked = append(tracked, consumer)
+	}
+	consumersLock.Unlock()
+
+	for _, consumer := range tracked {
+		if err := consumer.ensure(); err != nil {
+			node.HandleError(err, node.ERROR, "Failed to recover consumer "+consumer.config.Durable)
+		}
+	}
+}
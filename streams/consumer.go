@@ -0,0 +1,337 @@
+package streams
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/node"
+)
+
+// Handler processes one message. Returning nil acknowledges it, ErrNotHandled leaves it for
+// redelivery after the ack wait and any other error naks it so it is redelivered straight away.
+type Handler func(ctx context.Context, msg *nats.Msg) error
+
+// ErrNotHandled tells the consumer to leave a message unacknowledged
+var ErrNotHandled = errors.New("message not handled")
+
+// ConsumerOptions describe what a consumer reads and how it fetches
+type ConsumerOptions struct {
+	Stream  string
+	Subject string
+	// Durable names a consumer kept by the server across restarts, empty creates an ephemeral one
+	Durable string
+	// Group is the deliver group of a durable created here, so several processes share its messages
+	Group string
+	// Push has the server deliver messages instead of the consumer fetching them
+	Push bool
+	// BatchSize is how many messages a pull fetches at once, default 1
+	BatchSize int
+	// MaxWait is how long a pull waits for messages before fetching again, default 1s
+	MaxWait time.Duration
+	// Concurrency is how many messages are handled at once, default 1 which keeps them in order
+	Concurrency int
+	// Capacity, when set, is asked before every pull how many messages may be taken. At 0 the
+	// consumer waits and asks again, letting the caller hold off while it is busy or throttled.
+	Capacity func() int
+	// StopWhenEmpty stops a pull consumer once a fetch finds nothing, to read what is already queued
+	StopWhenEmpty bool
+	// OnFetch is told the outcome of every pull, for metrics
+	OnFetch func(count int, err error)
+}
+
+// capacityPoll is how often a consumer with no capacity asks again
+const capacityPoll = 500 * time.Millisecond
+
+// Consumer is a running consumer that can be stopped
+type Consumer struct {
+	options      ConsumerOptions
+	handler      Handler
+	subscription *nats.Subscription
+	ctx          context.Context
+	cancel       context.CancelFunc
+	work         chan *nats.Msg
+	errs         chan error
+	workers      sync.WaitGroup
+	done         chan struct{}
+}
+
+// Consume binds to a stream and runs handler on its messages until ctx ends or Stop is called.
+// Durable consumers are created from their declaration in streams.go, or from the options if
+// there is none, and are re-created if the server loses them.
+func Consume(ctx context.Context, js nats.JetStreamContext, options ConsumerOptions, handler Handler) (*Consumer, error) {
+	if options.BatchSize <= 0 {
+		options.BatchSize = 1
+	}
+	if options.MaxWait <= 0 {
+		options.MaxWait = time.Second
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = 1
+	}
+
+	c := &Consumer{
+		options: options,
+		handler: handler,
+		work:    make(chan *nats.Msg),
+		errs:    make(chan error, 64),
+		done:    make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+
+	if options.Durable != "" {
+		config := options.consumerConfig()
+		_, err := js.AddConsumer(options.Stream, config)
+		if err != nil && !errors.Is(err, nats.ErrConsumerNameAlreadyInUse) {
+			c.cancel()
+			node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to add consumer for subject %s", options.Subject))
+			return nil, fmt.Errorf("failed to add consumer: %v", err)
+		}
+		trackConsumer(js, options.Stream, config)
+	}
+
+	var err error
+	if options.Push {
+		c.subscription, err = js.Subscribe(options.Subject, c.deliver, c.bindOptions()...)
+	} else {
+		c.subscription, err = js.PullSubscribe(options.Subject, options.Durable, c.bindOptions()...)
+	}
+	if err != nil {
+		c.cancel()
+		node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to subscribe to %s on stream %s", options.Subject, options.Stream))
+		return nil, fmt.Errorf("failed to subscribe to %s: %v", options.Subject, err)
+	}
+
+	for i := 0; i < options.Concurrency; i++ {
+		c.workers.Add(1)
+		go c.run()
+	}
+	if options.Push {
+		go func() {
+			<-c.ctx.Done()
+			c.shutdown()
+		}()
+	} else {
+		go c.pull()
+	}
+
+	node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Consumer %s set up for subject %s", c.Name(), options.Subject))
+	return c, nil
+}
+
+// consumerConfig is the config a durable is created with
+func (o ConsumerOptions) consumerConfig() *nats.ConsumerConfig {
+	if declared, ok := DeclaredConsumer(o.Durable); ok {
+		return &declared
+	}
+	config := &nats.ConsumerConfig{
+		Durable:       o.Durable,
+		AckPolicy:     nats.AckExplicitPolicy,
+		FilterSubject: o.Subject,
+		DeliverPolicy: nats.DeliverAllPolicy,
+	}
+	if o.Group != "" {
+		config.DeliverGroup = o.Group
+		config.MaxDeliver = -1
+		config.AckWait = 30 * time.Second
+	}
+	if o.Push {
+		config.DeliverSubject = fmt.Sprintf("%s.%s", hash(o.Subject), o.Durable)
+	}
+	return config
+}
+
+// bindOptions attach the subscription to the stream, and to the durable when there is one
+func (c *Consumer) bindOptions() []nats.SubOpt {
+	options := []nats.SubOpt{nats.ManualAck()}
+	if c.options.Durable != "" {
+		return append(options, nats.Bind(c.options.Stream, c.options.Durable))
+	}
+	options = append(options, nats.BindStream(c.options.Stream))
+	if c.options.Push {
+		options = append(options, nats.AckExplicit())
+	}
+	return options
+}
+
+// deliver hands a pushed message to the workers, holding the delivery until one is free
+func (c *Consumer) deliver(msg *nats.Msg) {
+	select {
+	case c.work <- msg:
+	case <-c.ctx.Done():
+	}
+}
+
+// pull fetches messages for the workers until the consumer stops
+func (c *Consumer) pull() {
+	defer c.shutdown()
+
+	for c.ctx.Err() == nil {
+		// A fetch can only fail while NATS is away, so wait for it instead
+		if state, _ := Connection(); state != Connected {
+			c.sleep(capacityPoll)
+			continue
+		}
+
+		batch := c.options.BatchSize
+		if c.options.Capacity != nil {
+			if capacity := c.options.Capacity(); capacity < batch {
+				batch = capacity
+			}
+			if batch <= 0 {
+				c.sleep(capacityPoll)
+				continue
+			}
+		}
+
+		fetchCtx, cancel := context.WithTimeout(c.ctx, c.options.MaxWait)
+		messages, err := c.subscription.Fetch(batch, nats.Context(fetchCtx))
+		cancel()
+		if c.ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+			messages, err = nil, nil
+		}
+		if c.options.OnFetch != nil {
+			c.options.OnFetch(len(messages), err)
+		}
+		if err != nil {
+			// While NATS is away there is nothing to report, recovery waits for it to come back
+			if state, _ := Connection(); state == Connected {
+				c.report(fmt.Errorf("error fetching from %s: %v", c.options.Subject, err))
+			}
+			if c.options.Durable != "" {
+				if err := RecoverConsumer(c.ctx, c.options.Durable); err != nil {
+					return
+				}
+			} else {
+				c.sleep(Jitter(capacityPoll))
+			}
+			continue
+		}
+		if len(messages) == 0 && c.options.StopWhenEmpty {
+			node.HandleError(nil, node.INFO, fmt.Sprintf("No more messages for subject %s, stopping consumer", c.options.Subject))
+			return
+		}
+
+		for _, msg := range messages {
+			select {
+			case c.work <- msg:
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// run handles messages until the consumer stops. Messages fetched but not yet handled
+// by then are left unacknowledged and redelivered.
+func (c *Consumer) run() {
+	defer c.workers.Done()
+	for {
+		select {
+		case msg := <-c.work:
+			c.handle(msg)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// handle runs the handler on one message and settles it
+func (c *Consumer) handle(msg *nats.Msg) {
+	err := c.handler(c.ctx, msg)
+	switch {
+	case err == nil:
+		if err := msg.Ack(); err != nil && !errors.Is(err, nats.ErrMsgAlreadyAckd) {
+			c.report(fmt.Errorf("error acknowledging message on %s: %v", msg.Subject, err))
+		}
+	case errors.Is(err, ErrNotHandled):
+	default:
+		c.report(err)
+		if err := msg.Nak(); err != nil && !errors.Is(err, nats.ErrMsgAlreadyAckd) {
+			c.report(fmt.Errorf("error rejecting message on %s: %v", msg.Subject, err))
+		}
+	}
+}
+
+// report logs an error and passes it on to Errors, dropping it if nobody is reading
+func (c *Consumer) report(err error) {
+	node.HandleError(err, node.WARNING, "Consumer "+c.Name())
+	select {
+	case c.errs <- err:
+	default:
+	}
+}
+
+// sleep waits for d or until the consumer stops
+func (c *Consumer) sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.ctx.Done():
+	}
+}
+
+// shutdown stops delivery, lets the workers finish what they hold and releases the subscription
+func (c *Consumer) shutdown() {
+	c.cancel()
+	c.workers.Wait()
+	if err := c.subscription.Unsubscribe(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+		node.HandleError(err, node.WARNING, "Failed to unsubscribe consumer "+c.Name())
+	}
+	close(c.errs)
+	close(c.done)
+}
+
+// Stop ends the consumer and waits for messages being handled to finish.
+// A durable consumer stays on the server and carries on from where it stopped next time.
+func (c *Consumer) Stop() {
+	c.cancel()
+	<-c.done
+}
+
+// Done is closed once the consumer has stopped
+func (c *Consumer) Done() <-chan struct{} {
+	return c.done
+}
+
+// Errors reports fetch, handler and acknowledgement errors, and is closed when the consumer stops
+func (c *Consumer) Errors() <-chan error {
+	return c.errs
+}
+
+// Subscription is the underlying subscription, for consumer info
+func (c *Consumer) Subscription() *nats.Subscription {
+	return c.subscription
+}
+
+// Name is the durable name, or the subject for an ephemeral consumer
+func (c *Consumer) Name() string {
+	if c.options.Durable != "" {
+		return c.options.Durable
+	}
+	return c.options.Subject
+}
+
+// Decode wraps a handler that takes the message body decoded from JSON. A body that does not
+// decode is terminated, since redelivering it would only fail again.
+func Decode[T any](handler func(ctx context.Context, msg *nats.Msg, value T) error) Handler {
+	return func(ctx context.Context, msg *nats.Msg) error {
+		var value T
+		if err := json.Unmarshal(msg.Data, &value); err != nil {
+			if termErr := msg.Term(); termErr != nil {
+				node.HandleError(termErr, node.WARNING, "Failed to terminate undecodable message on "+msg.Subject)
+			}
+			return fmt.Errorf("failed to decode message on %s: %v", msg.Subject, err)
+		}
+		return handler(ctx, msg, value)
+	}
+}
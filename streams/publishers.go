@@ -1,121 +1,254 @@
-
 package streams
 
 import (
-    "context"
-    "encoding/json"
-    "fmt"
-    "time"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+
+	"github.com/mtmox/AI-cluster/node"
+)
 
-    "github.com/nats-io/nats.go"
-    "github.com/mtmox/AI-cluster/node"
+// Headers every message carries, so a request can be followed across nodes
+const (
+	HeaderTraceID  = "trace-id"
+	HeaderClientID = "client-id"
+	HeaderNodeID   = "node-id"
 )
 
-func PublishToNats(js nats.JetStreamContext, subject string, data interface{}) error {
-    jsonData, err := json.Marshal(data)
-    if err != nil {
-        node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to marshal data for subject %s", subject))
-        return fmt.Errorf("failed to marshal data: %v", err)
-    }
-
-    // Print the message exactly as it's being published
-    fmt.Printf("Publishing message to subject %s:\n%s\n", subject, string(jsonData))
-    node.HandleError(nil, node.INFO, fmt.Sprintf("Attempting to publish message to subject: %s", subject))
-
-    // Set a timeout for the publish operation
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-    defer cancel()
-
-    // Attempt to publish with context
-    ack, err := js.PublishMsg(&nats.Msg{
-        Subject: subject,
-        Data:    jsonData,
-    }, nats.Context(ctx))
-
-    if err != nil {
-        if err == context.DeadlineExceeded {
-            node.HandleError(err, node.ERROR, fmt.Sprintf("Publish operation timed out for subject %s", subject))
-            return fmt.Errorf("publish operation timed out: %v", err)
-        }
-        node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to publish message to subject %s", subject))
-        return fmt.Errorf("failed to publish message: %v", err)
-    }
-
-    if ack == nil {
-        node.HandleError(fmt.Errorf("no acknowledgment"), node.ERROR, fmt.Sprintf("No acknowledgment received from stream for subject %s", subject))
-        return fmt.Errorf("no acknowledgment received from stream")
-    }
-
-    node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Message published successfully to subject %s, sequence: %d", subject, ack.Sequence))
-    return nil
+// PublisherOptions tune a Publisher, zero values take the defaults
+type PublisherOptions struct {
+	// NodeID and ClientID are set on messages that do not carry them, NodeID defaults to this node
+	NodeID   string
+	ClientID string
+	// Timeout bounds each attempt, default 5s
+	Timeout time.Duration
+	// Retries is how often a publish that failed for a transient reason is repeated, default 3
+	Retries int
+	// Backoff is the wait before the first retry, doubling after each one, default 250ms
+	Backoff time.Duration
+	// MaxInFlight bounds the async publishes waiting for their ack, default 256
+	MaxInFlight int
+}
+
+// Publisher publishes to JetStream. Every message gets a Nats-Msg-Id, kept across retries,
+// so the stream drops a copy that was stored before an ack went missing.
+type Publisher struct {
+	js       nats.JetStreamContext
+	options  PublisherOptions
+	inFlight chan struct{}
+	pending  sync.WaitGroup
+	errs     []error
+	errsLock sync.Mutex
+}
+
+// NewPublisher returns a publisher for js
+func NewPublisher(js nats.JetStreamContext, options PublisherOptions) *Publisher {
+	if options.NodeID == "" {
+		options.NodeID = node.GetNodeID()
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 5 * time.Second
+	}
+	if options.Retries <= 0 {
+		options.Retries = 3
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = 250 * time.Millisecond
+	}
+	if options.MaxInFlight <= 0 {
+		options.MaxInFlight = 256
+	}
+	return &Publisher{
+		js:       js,
+		options:  options,
+		inFlight: make(chan struct{}, options.MaxInFlight),
+	}
+}
+
+type traceKey struct{}
+
+// WithTraceID carries a trace ID to the messages published with ctx
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	if traceID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, traceKey{}, traceID)
+}
+
+// TraceID returns the trace ID carried by ctx, if any
+func TraceID(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceKey{}).(string)
+	return traceID
+}
+
+// Publish publishes data and waits for the stream to store it. Header values already set,
+// including Nats-Msg-Id, are kept, anything missing is filled in.
+func (p *Publisher) Publish(ctx context.Context, subject string, data []byte, header nats.Header) (*nats.PubAck, error) {
+	msg := p.message(ctx, subject, data, header)
+	ack, err := p.publish(ctx, msg)
+	if err != nil {
+		node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to publish message to subject %s", subject))
+		return nil, err
+	}
+	node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Message published to subject %s, %d bytes, sequence: %d", subject, len(data), ack.Sequence))
+	return ack, nil
+}
+
+// PublishJSON publishes value encoded as JSON
+func (p *Publisher) PublishJSON(ctx context.Context, subject string, value interface{}, header nats.Header) (*nats.PubAck, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to marshal data for subject %s", subject))
+		return nil, fmt.Errorf("failed to marshal data: %v", err)
+	}
+	return p.Publish(ctx, subject, data, header)
+}
+
+// PublishAsync publishes without waiting for the ack, blocking only while MaxInFlight
+// publishes are unacknowledged. A failed publish is retried like Publish, errors that remain
+// are returned by Flush.
+func (p *Publisher) PublishAsync(ctx context.Context, subject string, data []byte, header nats.Header) error {
+	msg := p.message(ctx, subject, data, header)
+
+	select {
+	case p.inFlight <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	future, err := p.js.PublishMsgAsync(msg)
+	if err != nil {
+		<-p.inFlight
+		// The async path refused it outright, usually while reconnecting, so fall back to retrying
+		_, err = p.publish(ctx, msg)
+		return err
+	}
+
+	p.pending.Add(1)
+	go func() {
+		defer p.pending.Done()
+		defer func() { <-p.inFlight }()
+
+		var err error
+		select {
+		case <-future.Ok():
+			return
+		case err = <-future.Err():
+		case <-time.After(p.options.Timeout):
+			err = nats.ErrTimeout
+		}
+		// The retry reuses the message ID, so it is harmless if the first copy was stored after all
+		if transient(err) {
+			_, err = p.publish(context.Background(), msg)
+		}
+		if err != nil {
+			p.errsLock.Lock()
+			p.errs = append(p.errs, fmt.Errorf("publish to %s: %v", msg.Subject, err))
+			p.errsLock.Unlock()
+		}
+	}()
+	return nil
+}
+
+// Flush waits for every async publish to be acknowledged and returns the ones that failed
+func (p *Publisher) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	p.errsLock.Lock()
+	defer p.errsLock.Unlock()
+	err := errors.Join(p.errs...)
+	p.errs = nil
+	if err != nil {
+		node.HandleError(err, node.ERROR, "Async publishes failed")
+	}
+	return err
 }
 
-func PublishToNatsOutMessages(js nats.JetStreamContext, subject string, data []byte) error {
-    // Print the message exactly as it's being published
-    fmt.Printf("Publishing message to subject %s:\n%s\n", subject, string(data))
-    node.HandleError(nil, node.INFO, fmt.Sprintf("Attempting to publish message to subject: %s", subject))
-
-    // Set a timeout for the publish operation
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-    defer cancel()
-
-    // Attempt to publish with context
-    ack, err := js.PublishMsg(&nats.Msg{
-        Subject: subject,
-        Data:    data,
-    }, nats.Context(ctx))
-
-    if err != nil {
-        if err == context.DeadlineExceeded {
-            node.HandleError(err, node.ERROR, fmt.Sprintf("Publish operation timed out for subject %s", subject))
-            return fmt.Errorf("publish operation timed out: %v", err)
-        }
-        node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to publish message to subject %s", subject))
-        return fmt.Errorf("failed to publish message: %v", err)
-    }
-
-    if ack == nil {
-        node.HandleError(fmt.Errorf("no acknowledgment"), node.ERROR, fmt.Sprintf("No acknowledgment received from stream for subject %s", subject))
-        return fmt.Errorf("no acknowledgment received from stream")
-    }
-
-    node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Message published successfully to subject %s, sequence: %d", subject, ack.Sequence))
-    return nil
+// message builds the message with the standard headers and a message ID
+func (p *Publisher) message(ctx context.Context, subject string, data []byte, header nats.Header) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	for key, values := range header {
+		msg.Header[key] = values
+	}
+
+	setDefault := func(key, value string) {
+		if value != "" && msg.Header.Get(key) == "" {
+			msg.Header.Set(key, value)
+		}
+	}
+	setDefault(nats.MsgIdHdr, nuid.Next())
+	setDefault(HeaderNodeID, p.options.NodeID)
+	setDefault(HeaderClientID, p.options.ClientID)
+	// A message that is not part of a trace yet starts one
+	traceID := TraceID(ctx)
+	if traceID == "" {
+		traceID = nuid.Next()
+	}
+	setDefault(HeaderTraceID, traceID)
+	return msg
 }
 
-func PublishToNatsWithHeader(js nats.JetStreamContext, subject string, data []byte, header nats.Header) error {
-    node.HandleError(nil, node.INFO, fmt.Sprintf("Attempting to publish message to subject: %s", subject))
-    fmt.Printf("Message size: %d bytes\n", len(data))
-    fmt.Printf("Header: %v\n", header)
-
-    // Set a timeout for the publish operation
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-    defer cancel()
-
-    // Create the message
-    msg := &nats.Msg{
-        Subject: subject,
-        Header:  header,
-        Data:    data,
-    }
-
-    // Publish the message with options
-    ack, err := js.PublishMsg(msg, nats.Context(ctx))
-
-    if err != nil {
-        if err == context.DeadlineExceeded {
-            node.HandleError(err, node.ERROR, fmt.Sprintf("Publish operation timed out for subject %s", subject))
-            return fmt.Errorf("publish operation timed out: %v", err)
-        }
-        node.HandleError(err, node.ERROR, fmt.Sprintf("Failed to publish message to subject %s", subject))
-        return fmt.Errorf("failed to publish message: %v", err)
-    }
-
-    if ack == nil {
-        node.HandleError(fmt.Errorf("no acknowledgment"), node.ERROR, fmt.Sprintf("No acknowledgment received from stream for subject %s", subject))
-        return fmt.Errorf("no acknowledgment received from stream")
-    }
-
-    node.HandleError(nil, node.SUCCESS, fmt.Sprintf("Message successfully published to subject: %s, sequence: %d", subject, ack.Sequence))
-    return nil
-}
\ No newline at end of file
+// publish sends msg, retrying transient failures with backoff. While NATS is reconnecting it
+// holds the message for up to PublishBufferWindow and tries again once the connection is back.
+func (p *Publisher) publish(ctx context.Context, msg *nats.Msg) (*nats.PubAck, error) {
+	deadline := time.Now().Add(PublishBufferWindow)
+	backoff := p.options.Backoff
+	for attempt := 0; ; attempt++ {
+		remaining := time.Until(deadline)
+		if remaining <= 0 || !WaitConnected(remaining) {
+			return nil, fmt.Errorf("NATS unavailable for %s", PublishBufferWindow)
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, p.options.Timeout)
+		ack, err := p.js.PublishMsg(msg, nats.Context(attemptCtx))
+		cancel()
+		if err == nil {
+			return ack, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		// A dropped connection is waited out above and does not use up a retry
+		if state, _ := Connection(); state != Connected && time.Now().Before(deadline) {
+			node.HandleError(err, node.WARNING, fmt.Sprintf("NATS connection lost while publishing to %s, holding message", msg.Subject))
+			continue
+		}
+		if !transient(err) || attempt >= p.options.Retries {
+			return nil, fmt.Errorf("failed to publish message: %v", err)
+		}
+
+		node.HandleError(err, node.WARNING, fmt.Sprintf("Publish to %s failed, retrying in %s", msg.Subject, backoff))
+		select {
+		case <-time.After(Jitter(backoff)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// transient reports whether a publish that failed with err may succeed if repeated
+func transient(err error) bool {
+	return errors.Is(err, nats.ErrTimeout) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, nats.ErrNoResponders) ||
+		errors.Is(err, nats.ErrDisconnected) ||
+		errors.Is(err, nats.ErrConnectionReconnecting)
+}
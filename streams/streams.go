@@ -2,9 +2,12 @@
 package streams
 
 import (
+	"sync"
 	"time"
 
 	"github.com/nats-io/nats.go"
+
+	"github.com/mtmox/AI-cluster/constants"
 )
 
 // StreamConfig represents the configuration for a stream
@@ -15,6 +18,11 @@ type StreamConfig struct {
 	Discard		 nats.DiscardPolicy
 	MaxAge       time.Duration
 	MaxMsgs		 int64
+	// Zero values below leave the server default: 1 replica, file storage, no byte limit and a 2 minute duplicate window
+	Replicas     int
+	Storage      nats.StorageType
+	MaxBytes     int64
+	Duplicates   time.Duration
 }
 
 // Streams contains the configurations for all streams
@@ -30,10 +38,118 @@ var Streams = []StreamConfig{
 		Retention: nats.WorkQueuePolicy,
 	},
 	{
+		// Backends from before models moved to their own stream still publish here
 		Name: "nodes",
 		Subjects: []string{
 			"config.sync.models",
 		},
 		Retention: nats.WorkQueuePolicy,
 	},
-}
\ No newline at end of file
+	{
+		// Every frontend reads every model sync through its own consumer, so syncs are kept for a
+		// day rather than removed by whichever frontend reads them first
+		Name: "models",
+		Subjects: []string{
+			"models.sync",
+		},
+		Retention: nats.LimitsPolicy,
+		MaxAge:    24 * time.Hour,
+	},
+}
+
+var streamsLock sync.Mutex
+
+// StreamConfigs returns a copy of Streams, safe to read while limits change at runtime
+func StreamConfigs() []StreamConfig {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	return append([]StreamConfig{}, Streams...)
+}
+
+// SetStreamLimits changes the desired limits of a stream, zero leaves a limit as it is, so
+// reconciliation after a reconnect keeps limits applied from the cluster config
+func SetStreamLimits(name string, maxAge time.Duration, maxMsgs int64) {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	for i := range Streams {
+		if Streams[i].Name != name {
+			continue
+		}
+		if maxAge != 0 {
+			Streams[i].MaxAge = maxAge
+		}
+		if maxMsgs != 0 {
+			Streams[i].MaxMsgs = maxMsgs
+		}
+	}
+}
+
+// Consumers are the durable consumers reconciliation keeps in line with this file.
+// DurablePull and DurableGroupPull use these settings for a declared durable.
+var Consumers = []ConsumerConfig{
+	{
+		Stream: "messages",
+		Config: nats.ConsumerConfig{
+			Durable:       "message_processors",
+			DeliverGroup:  "message_processors",
+			AckPolicy:     nats.AckExplicitPolicy,
+			FilterSubject: "in.chat.>",
+			DeliverPolicy: nats.DeliverAllPolicy,
+			MaxDeliver:    -1,
+			AckWait:       30 * time.Second,
+		},
+	},
+}
+
+// RetiredConsumers are durables older versions created and this one no longer reads. Only an
+// explicit -reconcile deletes them, since nodes still on an older version may be using them.
+var RetiredConsumers = []ConsumerConfig{
+	// Every frontend shared out_chat_messages before responses were routed per client. It overlaps
+	// the per client consumers on the work queue stream, which cannot be created while it exists.
+	{Stream: "messages", Config: nats.ConsumerConfig{Durable: "out_chat_messages"}},
+	// Frontends shared config_sync_models on the nodes work queue, so each saw only some models
+	{Stream: "nodes", Config: nats.ConsumerConfig{Durable: "config_sync_models"}},
+}
+
+// ConsumerConfig is a durable consumer and the stream it belongs to
+type ConsumerConfig struct {
+	Stream string
+	Config nats.ConsumerConfig
+}
+
+// DeclaredConsumer returns the declared settings for a durable, if it is in Consumers
+func DeclaredConsumer(durable string) (nats.ConsumerConfig, bool) {
+	for _, consumer := range Consumers {
+		if consumer.Config.Durable == durable {
+			return consumer.Config, true
+		}
+	}
+	return nats.ConsumerConfig{}, false
+}
+
+// KeyValueConfig represents the configuration for a key-value bucket
+type KeyValueConfig struct {
+	Bucket  string
+	TTL     time.Duration
+	History uint8
+}
+
+// KeyValueBuckets contains the configurations for all key-value buckets
+var KeyValueBuckets = []KeyValueConfig{
+	{
+		// Entries expire when a node stops sending heartbeats
+		Bucket:  constants.HeartbeatBucket,
+		TTL:     15 * time.Second,
+		History: 1,
+	},
+	{
+		// Latest benchmark summary per node and model, read by routing and placement
+		Bucket:  constants.BenchmarkBucket,
+		History: 1,
+	},
+	{
+		// Shared defaults and per node overrides, with some history so a bad change can be rolled back
+		Bucket:  constants.ClusterConfigBucket,
+		History: 10,
+	},
+}